@@ -2,49 +2,83 @@ package rtreq
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/bbengfort/x/stats"
+	"golang.org/x/sync/errgroup"
 )
 
+// FailFastBackoff is the least time a benchmarked client waits before its
+// next request after a request fails fast without being sent.
+const FailFastBackoff = 10 * time.Millisecond
+
 // Benchmark the throughput in terms of messages per second to the zmqnet.
-func (c *Client) Benchmark(duration time.Duration, results string, retries int, timeout time.Duration, nClients int) error {
+// Only requests sent during the duration, after the warmup and before the
+// cooldown, are recorded. Failed requests are counted and the benchmark
+// continues unless they exceed the error budget, in which case the error is
+// returned. If a sampler is specified, the requests are also sampled every
+// interval throughout the benchmark.
+func (c *Client) Benchmark(duration time.Duration, phases Phases, results string, policy *RetryPolicy, budget *ErrorBudget, sampler *Sampler, nClients int) error {
 
 	// Initialize the client
-	c.messages = 0
-	c.latency = 0
-	c.nSent = 0
-	c.nRecv = 0
-	c.nBytes = 0
-	c.stats = new(stats.Statistics)
+	c.resetStats()
+	c.sampler = sampler
+	c.requests.reset()
 
 	// Initialize the results
 	extra := make(map[string]interface{})
 	extra["n_clients"] = nClients
 	extra["name"] = c.identity
+	extra["max attempts"] = policy.MaxAttempts
+	extra["think time"] = c.think.String()
+	phases.Serialize(extra)
 
-	// Initialize channels
-	timer := time.NewTimer(duration)
+	// Initialize channels, stop is closed when the timer is complete so that
+	// a pausing access does not send another request
+	timer := time.NewTimer(phases.Total(duration))
 	echan := make(chan error, 1)
 	done := make(chan bool, 1)
+	stop := make(chan struct{})
 	status("starting benchmark for %s", duration)
 
 	// Send the first access
-	go c.Access(done, echan, retries, timeout)
+	c.window = phases.window(duration)
+	sampler.start()
+	sampler.Join()
+	go c.Access(done, echan, policy)
 
 	// Continue until the timer is complete
 	for {
 		select {
 		case <-timer.C:
-			// Benchmarking complete
+			// Benchmarking complete, wait for the access in flight so that
+			// the results are not modified while they are written
+			close(stop)
+			select {
+			case <-done:
+			case <-echan:
+			}
+
+			c.elapsed = c.window.elapsed()
+			sampler.Leave()
+			sampler.close()
 			return c.Results(results, extra)
 		case err := <-echan:
-			// Something went wrong
-			return err
+			// Something went wrong, abort if there have been too many failures
+			debug("benchmark request failed: %s", err)
+			failed := c.outcomes.Failed()
+			if err = budget.Check(c.messages+failed, failed); err != nil {
+				sampler.Leave()
+				sampler.close()
+				return err
+			}
+			go c.thinkAccess(done, echan, stop, policy, c.backoff(err, policy))
 		case <-done:
-			go c.Access(done, echan, retries, timeout)
+			go c.thinkAccess(done, echan, stop, policy, 0)
 		}
 	}
 
@@ -52,15 +86,88 @@ func (c *Client) Benchmark(duration time.Duration, results string, retries int,
 
 // Access sends a request to the server and waits for a response, measuring
 // the latency of the message send to get throughput benchmarks.
-func (c *Client) Access(done chan<- bool, echan chan<- error, retries int, timeout time.Duration) {
+func (c *Client) Access(done chan<- bool, echan chan<- error, policy *RetryPolicy) {
+	if err := c.access(policy); err != nil {
+		echan <- err
+		return
+	}
+
+	// Signal done
+	done <- true
+}
+
+// Pause for the think time of the client and the backoff before the next
+// access, signaling done without an access if the benchmark is stopped.
+func (c *Client) thinkAccess(done chan<- bool, echan chan<- error, stop <-chan struct{}, policy *RetryPolicy, backoff time.Duration) {
+	pause := time.NewTimer(c.think.sample() + backoff)
+	defer pause.Stop()
+
+	select {
+	case <-pause.C:
+		c.Access(done, echan, policy)
+	case <-stop:
+		done <- true
+	}
+}
+
+// Returns how long to wait before the next benchmark request after the
+// request failed with the error. Requests that fail fast because the circuit
+// breaker is open or the server is dead wait for the breaker cooldown or a
+// heartbeat interval, but at least the first backoff of the policy, so that
+// the benchmark does not spin; other failures do not wait.
+func (c *Client) backoff(err error, policy *RetryPolicy) time.Duration {
+	var wait time.Duration
+	switch {
+	case errors.Is(err, ErrCircuitOpen):
+		if c.breaker != nil {
+			wait = c.breaker.Remaining()
+		}
+	case errors.Is(err, ErrServerDead):
+		if c.pulse != nil {
+			wait = c.pulse.interval
+		}
+	default:
+		return 0
+	}
+
+	if min := policy.Backoff(1); wait < min {
+		wait = min
+	}
+	if wait < FailFastBackoff {
+		wait = FailFastBackoff
+	}
+	return wait
+}
+
+// Send a benchmark request and record its latency and attempts, or count
+// it as failed if it does not receive a reply. Requests sent outside of the
+// measurement window of the benchmark are not recorded.
+func (c *Client) access(policy *RetryPolicy) error {
 	// Prepare the send
-	message := fmt.Sprintf("msg %d at %s", c.messages+1, time.Now())
+	class, message := c.requests.next(c.messages + 1)
 	start := time.Now()
+	outcomes := c.outcomes
 
 	// Send the request
-	if err := c.Send(message, retries, timeout); err != nil {
-		echan <- err
-		return
+	attempts, err := c.SendAttempts(message, policy)
+	if err != nil {
+		c.sampler.Fail()
+	} else {
+		c.sampler.Record(time.Since(start))
+	}
+
+	if !c.window.contains(start) {
+		c.outcomes = outcomes
+		return err
+	}
+
+	if attempts > 1 {
+		c.outcomes.Retries += uint64(attempts - 1)
+	}
+
+	if err != nil {
+		c.outcomes.fail(err)
+		return err
 	}
 
 	// Compute the throughput
@@ -68,22 +175,346 @@ func (c *Client) Access(done chan<- bool, echan chan<- error, retries int, timeo
 	c.messages++
 	c.latency += latency
 	c.stats.Update(float64(latency))
+	c.hist.Record(latency)
+	c.attempts.Update(float64(attempts))
+	c.requests.record(class, len(message), latency)
+	return nil
+}
 
-	// Signal done
-	done <- true
+// Reset the benchmark statistics of the client.
+func (c *Client) resetStats() {
+	c.messages = 0
+	c.latency = 0
+	c.nSent = 0
+	c.nRecv = 0
+	c.nBytes = 0
+	c.stats = new(stats.Statistics)
+	c.hist = NewHistogram()
+	c.attempts = new(stats.Statistics)
+	c.outcomes = Outcomes{}
+	c.window = window{}
+	c.sampler = nil
+	c.elapsed = 0
 }
 
 // Results saves the throughput to disk
 func (c *Client) Results(path string, data map[string]interface{}) error {
+	data["attempts distribution"] = c.attempts.Serialize()
+	if c.breaker != nil {
+		data["circuit breaker"] = c.breaker.Stats()
+	}
+	if c.sampler != nil {
+		data["time series"] = c.sampler.Serialize()
+	}
+	c.requests.serialize(data)
+	return writeResults(path, data, c.messages, c.latency, c.elapsed, &c.outcomes, c.stats, c.hist)
+}
+
+//===========================================================================
+// Pipelined Benchmarks
+//===========================================================================
+
+// Benchmark the throughput of the async client, keeping pipeline requests
+// outstanding at all times, sending the next request as soon as any reply
+// is received. Only requests sent during the duration, after the warmup and
+// before the cooldown, are recorded. Requests that time out are counted as
+// dropped and the benchmark continues unless failed requests exceed the error
+// budget. If a sampler is specified, the requests are also sampled every
+// interval throughout the benchmark.
+func (c *AsyncClient) Benchmark(duration time.Duration, phases Phases, results string, timeout time.Duration, budget *ErrorBudget, sampler *Sampler, pipeline, nClients int) error {
+	if pipeline < 1 {
+		pipeline = 1
+	}
+
+	// Initialize the client
+	c.messages = 0
+	c.latency = 0
+	c.nSent = 0
+	c.nRecv = 0
+	c.nBytes = 0
+	c.stats = new(stats.Statistics)
+	c.hist = NewHistogram()
+	c.outcomes = Outcomes{}
+	c.sampler = sampler
+	c.requests.reset()
+	c.elapsed = 0
+
+	// Initialize the results
+	extra := make(map[string]interface{})
+	extra["n_clients"] = nClients
+	extra["name"] = c.identity
+	extra["pipeline"] = pipeline
+	phases.Serialize(extra)
+
+	// Initialize channels, the replies channel has room for every
+	// outstanding request so that the callbacks never block.
+	timer := time.NewTimer(phases.Total(duration))
+	replies := make(chan *Future, pipeline)
+	callback := func(f *Future) { replies <- f }
+	status("starting benchmark for %s with %d outstanding requests", duration, pipeline)
+
+	// Fill the pipeline
+	c.window = phases.window(duration)
+	sampler.start()
+	sampler.Join()
+	for i := 0; i < pipeline; i++ {
+		c.Access(timeout, callback)
+	}
+
+	// Continue until the timer is complete
+	for {
+		select {
+		case <-timer.C:
+			// Benchmarking complete
+			c.elapsed = c.window.elapsed()
+			c.window = window{}
+			sampler.Leave()
+			sampler.close()
+			return c.Results(results, extra)
+		case future := <-replies:
+			if future.Err() != nil {
+				sampler.Fail()
+			} else {
+				sampler.Record(future.Latency())
+			}
+
+			if !c.window.contains(future.Sent) {
+				c.Access(timeout, callback)
+				continue
+			}
+
+			if err := future.Err(); err != nil {
+				// Something went wrong, abort if there have been too many failures
+				debug("benchmark request failed: %s", err)
+				if errors.Is(err, ErrRequestTimeout) {
+					c.outcomes.Timeouts++
+					err = WrapError("request %d timed out", ErrMessageDropped, future.ID)
+				}
+				c.outcomes.fail(err)
+
+				failed := c.outcomes.Failed()
+				if err = budget.Check(c.messages+failed, failed); err != nil {
+					sampler.Leave()
+					sampler.close()
+					return err
+				}
+
+				c.Access(timeout, callback)
+				continue
+			}
+
+			c.messages++
+			c.latency += future.Latency()
+			c.stats.Update(float64(future.Latency()))
+			c.hist.Record(future.Latency())
+			c.Access(timeout, callback)
+		}
+	}
+}
+
+// Access sends a request to the server without waiting for the response;
+// the latency of the request is measured by its future.
+func (c *AsyncClient) Access(timeout time.Duration, callback func(*Future)) *Future {
+	c.Lock()
+	class, message := c.requests.next(c.nextID + 1)
+	window := c.window
+	c.Unlock()
+
+	return c.Request(message, timeout, func(f *Future) {
+		if f.Err() == nil && window.contains(f.Sent) {
+			c.requests.record(class, len(message), f.Latency())
+		}
+		callback(f)
+	})
+}
+
+// Results saves the throughput to disk
+func (c *AsyncClient) Results(path string, data map[string]interface{}) error {
+	if c.sampler != nil {
+		data["time series"] = c.sampler.Serialize()
+	}
+	c.requests.serialize(data)
+	return writeResults(path, data, c.messages, c.latency, c.elapsed, &c.outcomes, c.stats, c.hist)
+}
+
+//===========================================================================
+// Fan-out Benchmarks
+//===========================================================================
+
+// BenchTopic is the topic messages are published to by fan-out benchmarks.
+const BenchTopic = "rtreq.bench"
+
+// Benchmark the fan-out throughput of the publish/subscribe service of the
+// server by publishing as fast as possible for the duration to nSubscribers
+// subscribers at subAddr, which are run in the same process so that the
+// latency of each delivery can be measured.
+func (p *Publisher) Benchmark(duration time.Duration, results, subAddr string, nSubscribers int) error {
+	if nSubscribers < 1 {
+		nSubscribers = 1
+	}
+
+	var mu sync.Mutex
+	var delivered uint64
+	latencies := new(stats.Statistics)
+	hist := NewHistogram()
+
+	// Connect and subscribe the subscribers, stopping the subscribers that
+	// have already started if any of them cannot be created
+	stop := make(chan struct{})
+	group := new(errgroup.Group)
+	for i := 0; i < nSubscribers; i++ {
+		sub, err := p.benchSubscriber(subAddr, i+1)
+		if err != nil {
+			close(stop)
+			group.Wait()
+			return err
+		}
+
+		group.Go(func() error {
+			defer sub.Close()
+			for {
+				select {
+				case <-stop:
+					return nil
+				default:
+				}
+
+				_, msg, err := sub.Recv(HeartbeatTick)
+				if err == ErrRecvTimeout {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+
+				latency := time.Since(time.Unix(0, msg.Timestamp))
+				mu.Lock()
+				delivered++
+				latencies.Update(float64(latency))
+				hist.Record(latency)
+				mu.Unlock()
+			}
+		})
+	}
+
+	// Wait for the subscriptions to reach the publisher
+	time.Sleep(DefaultJoinDelay)
+	status("starting fan-out benchmark to %d subscribers for %s", nSubscribers, duration)
+
+	var published uint64
+	start := time.Now()
+	for time.Since(start) < duration {
+		if err := p.Publish(BenchTopic, fmt.Sprintf("msg %d", published+1)); err != nil {
+			close(stop)
+			group.Wait()
+			return err
+		}
+		published++
+	}
+	elapsed := time.Since(start)
+
+	// Give the subscribers time to receive messages that are in flight
+	time.Sleep(DefaultJoinDelay)
+	close(stop)
+	if err := group.Wait(); err != nil {
+		return err
+	}
+
+	// Messages from other publishers to the topic may also be delivered
+	var dropped uint64
+	expected := published * uint64(nSubscribers)
+	if delivered < expected {
+		dropped = expected - delivered
+	}
+
+	data := map[string]interface{}{
+		"name":                          p.name,
+		"n_subscribers":                 nSubscribers,
+		"published":                     published,
+		"delivered":                     delivered,
+		"expected":                      expected,
+		"dropped":                       dropped,
+		"duration (nsec)":               elapsed.Nanoseconds(),
+		"publish throughput (msg/sec)":  float64(published) / elapsed.Seconds(),
+		"delivery throughput (msg/sec)": float64(delivered) / elapsed.Seconds(),
+		"latency distribution":          latencies.Serialize(),
+		"latency percentiles":           hist.Serialize(),
+		"latency histogram":             hist,
+	}
+
+	status(
+		"published %d messages to %d subscribers in %0.3f seconds - %0.3f msg/sec delivered (%d dropped) - %s",
+		published, nSubscribers, elapsed.Seconds(), data["delivery throughput (msg/sec)"], dropped, hist,
+	)
+	return appendJSON(results, data)
+}
+
+// Create, connect and subscribe the nth subscriber of a fan-out benchmark,
+// closing the subscriber if it cannot be subscribed.
+func (p *Publisher) benchSubscriber(subAddr string, n int) (sub *Subscriber, err error) {
+	if sub, err = NewSubscriber(subAddr, fmt.Sprintf("%s-sub-%d", p.name, n), p.context); err != nil {
+		return nil, err
+	}
+
+	sub.SetSecurity(p.security)
+	if p.signer != nil {
+		sub.SetSigner(p.signer.Clone())
+	}
+
+	if err = sub.Connect(); err == nil {
+		err = sub.Subscribe(BenchTopic)
+	}
+
+	if err != nil {
+		sub.Close()
+		return nil, err
+	}
+	return sub, nil
+}
+
+// Helper function to write the results of a benchmark to disk.
+// The throughput is reported both as messages divided by the sum of their
+// latencies and by the wall-clock duration of the benchmark; the two only
+// agree when requests do not overlap and are sent back to back.
+func writeResults(path string, data map[string]interface{}, messages uint64, latency, elapsed time.Duration, outcomes *Outcomes, latencies *stats.Statistics, hist *Histogram) error {
 	debug("writing results to %s", path)
-	data["messages"] = c.messages
-	data["latency (nsec)"] = c.latency.Nanoseconds()
-	data["throughput (msg/sec)"] = float64(c.messages) / c.latency.Seconds()
-	data["latency distribution"] = c.stats.Serialize()
-	status("%d messages in %0.3f seconds - %0.3f msg/sec", c.messages, c.latency.Seconds(), data["throughput (msg/sec)"])
+	throughput, concurrency := wallClock(messages, latency, elapsed)
+	for key, count := range outcomes.Serialize() {
+		data[key] = count
+	}
+
+	// No latency is recorded if no request succeeded
+	var latencyThroughput float64
+	if latency > 0 {
+		latencyThroughput = float64(messages) / latency.Seconds()
+	}
+
+	data["messages"] = messages
+	data["latency (nsec)"] = latency.Nanoseconds()
+	data["duration (nsec)"] = elapsed.Nanoseconds()
+	data["throughput (msg/sec)"] = latencyThroughput
+	data["wall-clock throughput (msg/sec)"] = throughput
+	data["achieved concurrency"] = concurrency
+	data["latency distribution"] = latencies.Serialize()
+	data["latency percentiles"] = hist.Serialize()
+	data["latency histogram"] = hist
+	status(
+		"%d messages in %0.3f seconds - %0.3f msg/sec with %0.2f concurrent requests - %s - %s",
+		messages, elapsed.Seconds(), throughput, concurrency, outcomes, hist,
+	)
 	return appendJSON(path, data)
 }
 
+// Computes the wall-clock throughput of the messages completed during the
+// elapsed time, and the average number of requests in flight during that
+// time (by Little's law, the total latency divided by the elapsed time).
+func wallClock(messages uint64, latency, elapsed time.Duration) (throughput, concurrency float64) {
+	if elapsed <= 0 {
+		return 0, 0
+	}
+	return float64(messages) / elapsed.Seconds(), latency.Seconds() / elapsed.Seconds()
+}
+
 // Helper function to append json data as a one line string to the end of a
 // results file without deleting the previous contents in it.
 func appendJSON(path string, val interface{}) error {
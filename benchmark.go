@@ -0,0 +1,256 @@
+package rtreq
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/bbengfort/x/stats"
+	"golang.org/x/sync/errgroup"
+)
+
+// NewBenchmark creates a benchmark that runs nClients concurrent clients
+// taken from the pool, which must be able to hold all of them at once.
+func NewBenchmark(pool *ClientPool, nClients int) (*Benchmark, error) {
+	if nClients < 1 {
+		nClients = 1
+	}
+
+	if nClients > pool.size {
+		return nil, fmt.Errorf("pool of %d clients cannot run %d concurrent clients", pool.size, nClients)
+	}
+
+	return &Benchmark{pool: pool, nClients: nClients}, nil
+}
+
+//===========================================================================
+// Concurrent Benchmarks
+//===========================================================================
+
+// Benchmark drives concurrent clients in the same process, each on its own
+// go routine with its own socket, that send requests to the server in a
+// closed loop for the duration of the benchmark. The counts and latencies of
+// each client are recorded individually and aggregated in the results.
+type Benchmark struct {
+	pool     *ClientPool   // pool the clients are taken from
+	nClients int           // number of concurrent clients
+	clients  []*Client     // the clients of the most recent run
+	phases   Phases        // warmup and cooldown of the most recent run
+	sampler  *Sampler      // time series of the most recent run, if sampled
+	workload *Workload     // requests sent by the clients, default if nil
+	think    ThinkTime     // pause of each client between requests
+	ramp     Ramp          // how the clients are started
+	elapsed  time.Duration // measured duration of the most recent run
+	requests uint64        // requests sent by all clients (atomic)
+	failed   uint64        // requests that failed for all clients (atomic)
+}
+
+// SetWorkload specifies the mix of requests the clients send; if nil, small
+// numbered messages are sent. Each client sends its own stream of requests.
+func (b *Benchmark) SetWorkload(workload *Workload) {
+	b.workload = workload
+}
+
+// SetThinkTime specifies how long each client pauses after a reply before
+// sending its next request.
+func (b *Benchmark) SetThinkTime(think ThinkTime) {
+	b.think = think
+}
+
+// SetRamp specifies how the clients are started over time rather than all
+// at the beginning of the benchmark. Ramps longer than the warmup include
+// the ramp in the measured results.
+func (b *Benchmark) SetRamp(ramp Ramp) {
+	b.ramp = ramp
+}
+
+// Run the benchmark for the duration, sending requests with the retry
+// policy. All clients are connected before the benchmark starts so that
+// connecting is not measured, and only requests sent during the duration,
+// after the warmup and before the cooldown, are recorded. Failed requests are
+// counted and the clients continue; if the failed requests of all clients
+// exceed the error budget, all clients stop and the error is returned. If a
+// sampler is specified, the requests of all clients are also sampled every
+// interval throughout the benchmark.
+func (b *Benchmark) Run(duration time.Duration, phases Phases, policy *RetryPolicy, budget *ErrorBudget, sampler *Sampler) (err error) {
+	b.clients = make([]*Client, 0, b.nClients)
+	b.phases = phases
+	b.sampler = sampler
+	atomic.StoreUint64(&b.requests, 0)
+	atomic.StoreUint64(&b.failed, 0)
+	defer b.release()
+
+	for i := 0; i < b.nClients; i++ {
+		var client *Client
+		if client, err = b.pool.Get(); err != nil {
+			return err
+		}
+
+		client.resetStats()
+		client.requests = b.workload.stream(i)
+		b.clients = append(b.clients, client)
+	}
+
+	status("starting benchmark of %d clients for %s", b.nClients, duration)
+	measure := phases.window(duration)
+	deadline := time.Now().Add(phases.Total(duration))
+	sampler.start()
+	group, ctx := errgroup.WithContext(context.Background())
+	for i, client := range b.clients {
+		client := client
+		client.window = measure
+		client.sampler = sampler
+		client.think = b.think
+		delay := b.ramp.Delay(i, len(b.clients))
+		group.Go(func() error {
+			// Wait for the client to be started by the ramp
+			if !pause(ctx, delay) {
+				return nil
+			}
+
+			sampler.Join()
+			defer sampler.Leave()
+			for time.Now().Before(deadline) {
+				select {
+				case <-ctx.Done():
+					return nil
+				default:
+				}
+
+				var backoff time.Duration
+				requests := atomic.AddUint64(&b.requests, 1)
+				if err := client.access(policy); err != nil {
+					debug("client %s request failed: %s", client.identity, err)
+					if err = budget.Check(requests, atomic.AddUint64(&b.failed, 1)); err != nil {
+						return err
+					}
+					backoff = client.backoff(err, policy)
+				}
+
+				if !pause(ctx, client.think.sample()+backoff) {
+					return nil
+				}
+			}
+			return nil
+		})
+	}
+
+	err = group.Wait()
+	b.elapsed = measure.elapsed()
+	sampler.close()
+	return err
+}
+
+// Results aggregates the results of each client of the most recent run and
+// appends them along with the per-client results to the path. The total
+// throughput is the sum of the latency-sum throughput of each client; the
+// wall-clock throughput is the total messages divided by the duration.
+func (b *Benchmark) Results(path string, data map[string]interface{}) error {
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+
+	var messages uint64
+	var outcomes Outcomes
+	var latency time.Duration
+	var throughput float64
+	latencies := new(stats.Statistics)
+	attempts := new(stats.Statistics)
+	hist := b.Histogram()
+	clients := make([]map[string]interface{}, 0, len(b.clients))
+
+	for _, client := range b.clients {
+		messages += client.messages
+		outcomes.Add(client.outcomes)
+		latency += client.latency
+		latencies.Append(client.stats)
+		attempts.Append(client.attempts)
+
+		var clientThroughput float64
+		if client.latency > 0 {
+			clientThroughput = float64(client.messages) / client.latency.Seconds()
+		}
+		throughput += clientThroughput
+
+		clients = append(clients, map[string]interface{}{
+			"name":                 client.identity,
+			"messages":             client.messages,
+			"outcomes":             client.outcomes,
+			"latency (nsec)":       client.latency.Nanoseconds(),
+			"throughput (msg/sec)": clientThroughput,
+			"latency distribution": client.stats.Serialize(),
+			"latency percentiles":  client.hist.Serialize(),
+		})
+	}
+
+	data["n_clients"] = len(b.clients)
+	data["think time"] = b.think.String()
+	data["ramp"] = b.ramp.String()
+	b.phases.Serialize(data)
+	data["clients"] = clients
+	data["messages"] = messages
+	for key, count := range outcomes.Serialize() {
+		data[key] = count
+	}
+	data["latency (nsec)"] = latency.Nanoseconds()
+	data["throughput (msg/sec)"] = throughput
+	data["duration (nsec)"] = b.elapsed.Nanoseconds()
+	data["wall-clock throughput (msg/sec)"], data["achieved concurrency"] = wallClock(messages, latency, b.elapsed)
+	data["latency distribution"] = latencies.Serialize()
+	data["latency percentiles"] = hist.Serialize()
+	data["latency histogram"] = hist
+	data["attempts distribution"] = attempts.Serialize()
+	data["pool"] = b.pool.Stats()
+	if b.pool.breaker != nil {
+		data["circuit breaker"] = b.pool.breaker.Stats()
+	}
+	if b.sampler != nil {
+		data["time series"] = b.sampler.Serialize()
+	}
+	if b.workload != nil {
+		data["workload"] = b.workload.Serialize()
+	}
+
+	debug("writing results to %s", path)
+	status(
+		"%d messages from %d clients in %0.3f seconds - %0.3f msg/sec with %0.2f concurrent requests - %s - %s",
+		messages, len(b.clients), b.elapsed.Seconds(), data["wall-clock throughput (msg/sec)"],
+		data["achieved concurrency"], &outcomes, hist,
+	)
+	return appendJSON(path, data)
+}
+
+// Histogram returns the latencies of all clients of the most recent run
+// merged into a single histogram.
+func (b *Benchmark) Histogram() *Histogram {
+	hist := NewHistogram()
+	for _, client := range b.clients {
+		hist.Merge(client.hist)
+	}
+	return hist
+}
+
+// Wait for the duration, returning false if the benchmark was stopped first.
+func pause(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Return the clients of the run to the pool.
+func (b *Benchmark) release() {
+	for _, client := range b.clients {
+		b.pool.Put(client, nil)
+	}
+}
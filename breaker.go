@@ -0,0 +1,219 @@
+package rtreq
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	pb "github.com/bbengfort/rtreq/msg"
+)
+
+// Default circuit breaker values used by the CLI.
+const (
+	DefaultBreakerThreshold = 5
+	DefaultBreakerCooldown  = 10 * time.Second
+)
+
+//===========================================================================
+// Circuit Breaker
+//===========================================================================
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState uint8
+
+// States of the circuit breaker: requests are sent while closed, fail fast
+// while open, and a single trial request is sent while half-open.
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+var breakerStateStrings = [...]string{"closed", "open", "half-open"}
+
+// String returns a human readable representation of the state.
+func (s BreakerState) String() string {
+	return breakerStateStrings[s]
+}
+
+// MarshalJSON serializes the state as its string representation.
+func (s BreakerState) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf("%q", s.String())), nil
+}
+
+// CircuitBreaker stops a client from sending requests to a server that is
+// failing. After threshold consecutive failures the breaker opens and all
+// requests fail fast with ErrCircuitOpen. Once the cooldown has passed the
+// breaker is half-open and allows a single trial request; if it succeeds the
+// breaker closes, otherwise it opens again for another cooldown. A breaker
+// may be shared by all of the clients that connect to the same server, so
+// the results of requests that were allowed before the breaker last opened
+// are ignored when they finish late.
+type CircuitBreaker struct {
+	sync.Mutex
+	threshold  int           // consecutive failures that open the breaker
+	cooldown   time.Duration // time the breaker stays open before a trial
+	state      BreakerState  // the current state of the breaker
+	failures   int           // the number of consecutive failures
+	opened     time.Time     // the time the breaker was last opened
+	generation uint64        // incremented every time the breaker opens
+	trial      bool          // if a trial request is in flight while half-open
+	stats      BreakerStats  // counts of transitions and fast failures
+}
+
+// BreakerToken is returned by the breaker for a request it allowed, and must
+// be passed back with the result of the request when it is recorded.
+type BreakerToken struct {
+	generation uint64 // the generation of the breaker when the request was allowed
+	trial      bool   // if the request is the trial request while half-open
+}
+
+// BreakerStats reports the state of the breaker and how often it changed.
+type BreakerStats struct {
+	State      BreakerState `json:"state"`       // the current state
+	Failures   int          `json:"failures"`    // current consecutive failures
+	Opened     uint64       `json:"opened"`      // transitions to open
+	HalfOpened uint64       `json:"half_opened"` // transitions to half-open
+	Closed     uint64       `json:"closed"`      // transitions back to closed
+	FastFailed uint64       `json:"fast_failed"` // requests failed while open
+}
+
+// NewCircuitBreaker creates a closed breaker that opens after threshold
+// consecutive failures and allows a trial request after the cooldown.
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &CircuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// Allow returns a token for the request if it may be sent, otherwise an
+// error wrapping ErrCircuitOpen with the time remaining until a trial request
+// is allowed.
+func (b *CircuitBreaker) Allow() (BreakerToken, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		remaining := b.cooldown - time.Since(b.opened)
+		if remaining > 0 {
+			b.stats.FastFailed++
+			return BreakerToken{}, WrapError("retry in %s", ErrCircuitOpen, remaining)
+		}
+
+		b.transition(BreakerHalfOpen)
+		b.trial = true
+		return BreakerToken{generation: b.generation, trial: true}, nil
+	case BreakerHalfOpen:
+		if b.trial {
+			b.stats.FastFailed++
+			return BreakerToken{}, WrapError("trial request in flight", ErrCircuitOpen)
+		}
+
+		b.trial = true
+		return BreakerToken{generation: b.generation, trial: true}, nil
+	default:
+		return BreakerToken{generation: b.generation}, nil
+	}
+}
+
+// Record the result of the request that was allowed with the token. Errors
+// that indicate the server is failing count toward opening the breaker;
+// errors caused by the request itself count as successes. Only the result of
+// the trial request changes the state of a half-open breaker, and results of
+// requests allowed before the breaker last opened are ignored.
+func (b *CircuitBreaker) Record(token BreakerToken, err error) {
+	b.Lock()
+	defer b.Unlock()
+
+	if token.generation != b.generation || token.trial != (b.state == BreakerHalfOpen) {
+		return
+	}
+
+	b.trial = false
+	if !failing(err) {
+		b.failures = 0
+		if b.state != BreakerClosed {
+			b.transition(BreakerClosed)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.opened = time.Now()
+		b.generation++
+		b.transition(BreakerOpen)
+	}
+}
+
+// Remaining returns the time until the open breaker allows a trial request,
+// zero if the breaker is not open or the cooldown has passed.
+func (b *CircuitBreaker) Remaining() time.Duration {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.state != BreakerOpen {
+		return 0
+	}
+
+	if remaining := b.cooldown - time.Since(b.opened); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// State returns the current state of the breaker.
+func (b *CircuitBreaker) State() BreakerState {
+	b.Lock()
+	defer b.Unlock()
+	return b.state
+}
+
+// Stats returns a snapshot of the breaker statistics.
+func (b *CircuitBreaker) Stats() BreakerStats {
+	b.Lock()
+	defer b.Unlock()
+
+	stats := b.stats
+	stats.State = b.state
+	stats.Failures = b.failures
+	return stats
+}
+
+// Change the state of the breaker, logging and counting the transition. Must
+// be called with the lock held.
+func (b *CircuitBreaker) transition(state BreakerState) {
+	switch state {
+	case BreakerOpen:
+		b.stats.Opened++
+		warn("circuit breaker opened after %d failures, cooling down for %s", b.failures, b.cooldown)
+	case BreakerHalfOpen:
+		b.stats.HalfOpened++
+		info("circuit breaker half-open, sending trial request")
+	case BreakerClosed:
+		b.stats.Closed++
+		status("circuit breaker closed")
+	}
+	b.state = state
+}
+
+// Determine if an error indicates that the server is failing: the request
+// timed out, the socket failed, or the server replied that it is unavailable
+// or had an internal error.
+func failing(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var serr *StatusError
+	switch {
+	case errors.As(err, &serr):
+		return serr.Code == pb.Status_UNAVAILABLE || serr.Code == pb.Status_INTERNAL
+	case errors.Is(err, ErrRejected), errors.Is(err, ErrRateLimited):
+		return false
+	}
+	return true
+}
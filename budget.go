@@ -0,0 +1,100 @@
+package rtreq
+
+import (
+	"errors"
+	"fmt"
+)
+
+// BudgetMinRequests is the number of requests that must be sent before the
+// failure rate of an error budget is enforced, so that a benchmark is not
+// aborted by a failure among its first few requests.
+const BudgetMinRequests = 100
+
+//===========================================================================
+// Request Outcomes
+//===========================================================================
+
+// Outcomes counts what happened to the requests sent during a benchmark
+// other than their successful replies, which are counted as messages.
+type Outcomes struct {
+	Timeouts uint64 `json:"timeouts"` // attempts that timed out waiting for a reply
+	Retries  uint64 `json:"retries"`  // attempts sent after the first
+	Resets   uint64 `json:"resets"`   // times the socket was reset after a timeout
+	Drops    uint64 `json:"drops"`    // requests dropped after every attempt timed out
+	Failures uint64 `json:"failures"` // requests that failed with any other error
+}
+
+// Failed returns the number of requests that did not receive a reply.
+func (o *Outcomes) Failed() uint64 {
+	return o.Drops + o.Failures
+}
+
+// Add the counts of another set of outcomes to these.
+func (o *Outcomes) Add(other Outcomes) {
+	o.Timeouts += other.Timeouts
+	o.Retries += other.Retries
+	o.Resets += other.Resets
+	o.Drops += other.Drops
+	o.Failures += other.Failures
+}
+
+// Serialize the counts for the results.
+func (o *Outcomes) Serialize() map[string]interface{} {
+	return map[string]interface{}{
+		"timeouts": o.Timeouts,
+		"retries":  o.Retries,
+		"resets":   o.Resets,
+		"drops":    o.Drops,
+		"failures": o.Failures,
+	}
+}
+
+// String returns the counts for the results line.
+func (o *Outcomes) String() string {
+	return fmt.Sprintf(
+		"%d timeouts, %d retries, %d resets, %d drops, %d failures",
+		o.Timeouts, o.Retries, o.Resets, o.Drops, o.Failures,
+	)
+}
+
+// Count the request error in the outcomes.
+func (o *Outcomes) fail(err error) {
+	if errors.Is(err, ErrMessageDropped) {
+		o.Drops++
+		return
+	}
+	o.Failures++
+}
+
+//===========================================================================
+// Error Budgets
+//===========================================================================
+
+// ErrorBudget is the number and fraction of failed requests a benchmark
+// tolerates before it is aborted; a nil budget tolerates any failures.
+// Requests fail if they are dropped after every attempt timed out or if they
+// return any other error.
+type ErrorBudget struct {
+	MaxFailures    uint64  // failed requests tolerated, 0 for no limit
+	MaxFailureRate float64 // fraction of failed requests tolerated, 0 for no limit
+}
+
+// Check returns an error wrapping ErrBudgetExceeded if the failed requests
+// out of all of the requests sent exceed the budget. The failure rate is not
+// checked until at least BudgetMinRequests requests have been sent.
+func (b *ErrorBudget) Check(requests, failed uint64) error {
+	if b == nil {
+		return nil
+	}
+
+	if b.MaxFailures > 0 && failed > b.MaxFailures {
+		return WrapError("%d requests failed", ErrBudgetExceeded, failed)
+	}
+
+	if b.MaxFailureRate > 0 && requests >= BudgetMinRequests {
+		if rate := float64(failed) / float64(requests); rate > b.MaxFailureRate {
+			return WrapError("%d of %d requests failed (%0.1f%%)", ErrBudgetExceeded, failed, requests, rate*100)
+		}
+	}
+	return nil
+}
@@ -1,8 +1,9 @@
 package rtreq
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
-	"math/rand"
 	"time"
 
 	pb "github.com/bbengfort/rtreq/msg"
@@ -35,7 +36,17 @@ type Client struct {
 	messages uint64            // number of messages sent to measure throughput
 	latency  time.Duration     // total time to send messages for throughput
 	stats    *stats.Statistics // distribution of message latency
-	identity string            // the identity being sent to the server
+	hist     *Histogram        // histogram of message latency for percentiles
+	window   window            // requests recorded by the benchmark
+	sampler  *Sampler          // time series of the benchmark, if sampled
+	requests *requestStream    // requests sent by benchmarks, default if nil
+	think    ThinkTime         // pause between requests sent by benchmarks
+	elapsed  time.Duration     // wall-clock duration of the benchmark
+	attempts *stats.Statistics // distribution of attempts per message
+	outcomes Outcomes          // counts of timeouts, retries and failures
+	breaker  *CircuitBreaker   // fails requests fast while the server is down
+	pulse    *Heartbeat        // heartbeats to the server, nil if not sent
+	notices  *Subscription     // notifications from the server, nil if not subscribed
 }
 
 // Connect to the remote peer
@@ -45,12 +56,21 @@ func (c *Client) Connect() (err error) {
 		return err
 	}
 
-	// Create an identity for the client
-	// NOTE: the identity must be unique - do not rely on randomness since
-	// parallel instantiation may result in the same seed!
-	c.identity = fmt.Sprintf("%s-%04X", c.name, rand.Intn(0x10000))
+	// Create an identity for the client if it does not have one, keeping
+	// it stable across resets, and a new id for this connection.
+	if c.identity == "" {
+		c.identity = newIdentity(c.name)
+	}
+	c.conn = newConnectionID()
 	c.sock.SetIdentity(c.identity)
 
+	// Configure CURVE security if required
+	if c.security != nil {
+		if err = c.security.Client(c.sock); err != nil {
+			return err
+		}
+	}
+
 	// Connect to the server
 	ep := c.addr
 	if err = c.sock.Connect(ep); err != nil {
@@ -61,11 +81,12 @@ func (c *Client) Connect() (err error) {
 	return nil
 }
 
-// Reset the socket by setting the linger to 0, closing it, then reconnecting.
+// Reset the socket by setting the linger to 0, closing it, then reconnecting
+// with the same identity.
 func (c *Client) Reset() error {
 
-	// Close the socket
-	if err := c.Close(); err != nil {
+	// Close the socket, leaving heartbeats running
+	if err := c.Transporter.Close(); err != nil {
 		return err
 	}
 
@@ -73,62 +94,245 @@ func (c *Client) Reset() error {
 	return c.Connect()
 }
 
-//===========================================================================
-// Transport Methods
-//===========================================================================
+// ResetIdentity resets the socket like Reset, but reconnects with a newly
+// generated identity.
+func (c *Client) ResetIdentity() error {
+	c.identity = ""
+	return c.Reset()
+}
+
+// Close the socket, stop sending heartbeats and unsubscribe from
+// notifications.
+func (c *Client) Close() error {
+	if c.pulse != nil {
+		if err := c.pulse.close(); err != nil {
+			warn("could not stop heartbeats: %s", err)
+		}
+		c.pulse = nil
+	}
+
+	if c.notices != nil {
+		if err := c.notices.close(); err != nil {
+			warn("could not unsubscribe from notifications: %s", err)
+		}
+		c.notices = nil
+	}
+	return c.Transporter.Close()
+}
+
+// Subscribe to notifications the server sends on the address, returning a
+// channel they are delivered on that is closed when the client is closed.
+// Notifications are dropped if the channel is not read from quickly enough.
+// Must be called after Connect.
+func (c *Client) Subscribe(addr string) (<-chan *pb.BasicMessage, error) {
+	if c.notices != nil {
+		return nil, errors.New("already subscribed to notifications")
+	}
 
-// Send a message to the remote peer in a safe fashion, specifying the # of
-// retries and the timeout to wait on.
-func (c *Client) Send(message string, retries int, timeout time.Duration) error {
-	if err := c.send(message); err != nil {
+	notices := &Subscription{
+		transporter: &c.Transporter,
+		identity:    c.identity,
+		addr:        fmt.Sprintf("tcp://%s", addr),
+	}
+	if err := notices.start(); err != nil {
+		return nil, err
+	}
+
+	c.notices = notices
+	return notices.notifications, nil
+}
+
+// StartHeartbeat sends heartbeats to the server every interval from a
+// companion socket. Requests fail fast with ErrServerDead if the server has
+// not replied to the last liveness heartbeats. Must be called after Connect.
+func (c *Client) StartHeartbeat(interval time.Duration, liveness int) error {
+	if c.pulse != nil {
+		return errors.New("heartbeats have already been started")
+	}
+
+	pulse := newHeartbeat(&c.Transporter, interval, liveness)
+	if err := pulse.start(); err != nil {
 		return err
 	}
 
-	for {
+	c.pulse = pulse
+	return nil
+}
 
-		// Poll socket for a reply, with timeout
-		poller := zmq.NewPoller()
-		poller.Add(c.sock, zmq.POLLIN)
-		sockets, err := poller.PollAll(timeout)
-		if err != nil {
-			return err
+// Heartbeat returns the heartbeats of the client, nil if not started.
+func (c *Client) Heartbeat() *Heartbeat {
+	return c.pulse
+}
+
+// SetCircuitBreaker specifies a circuit breaker to fail requests fast when
+// the server is failing; if nil, requests are always attempted.
+func (c *Client) SetCircuitBreaker(breaker *CircuitBreaker) {
+	c.breaker = breaker
+}
+
+// SetWorkload specifies the mix of requests the client sends when it is
+// benchmarked; if nil, small numbered messages are sent.
+func (c *Client) SetWorkload(workload *Workload) {
+	c.requests = workload.stream(0)
+}
+
+// SetThinkTime specifies how long the client pauses after a reply before it
+// sends its next request when it is benchmarked.
+func (c *Client) SetThinkTime(think ThinkTime) {
+	c.think = think
+}
+
+// CircuitBreaker returns the circuit breaker of the client, if any.
+func (c *Client) CircuitBreaker() *CircuitBreaker {
+	return c.breaker
+}
+
+//===========================================================================
+// Transport Methods
+//===========================================================================
+
+// Send a message to the remote peer in a safe fashion, retrying according to
+// the retry policy.
+func (c *Client) Send(message string, policy *RetryPolicy) error {
+	_, err := c.SendAttempts(message, policy)
+	return err
+}
+
+// SendAttempts sends a message to the remote peer, retrying according to the
+// retry policy, and returns the number of attempts made. If the attempts are
+// exhausted because the server did not reply, the message is dropped and an
+// error wrapping ErrMessageDropped is returned. If the
+// client has a circuit breaker that is open, it fails fast with an error
+// wrapping ErrCircuitOpen without sending the message, and if the client
+// sends heartbeats that the server has stopped replying to, it fails fast
+// with ErrServerDead.
+func (c *Client) SendAttempts(message string, policy *RetryPolicy) (attempts int, err error) {
+	for attempts = 1; ; attempts++ {
+		if c.pulse != nil && !c.pulse.Alive() {
+			return attempts - 1, WrapError("last heartbeat reply at %s", ErrServerDead, c.pulse.LastSeen().Format(time.RFC3339))
 		}
 
-		// Process a reply and exit if the reply is valid. Otherwise clsoe
-		// socket and retry the message for num retries. Abandon after we
-		// exhaust the number of allocated retries.
-		if sock := sockets[0]; sock.Events&zmq.POLLIN != 0 {
-			data, err := sock.Socket.RecvBytes(0)
-			if err != nil {
-				return err
+		var token BreakerToken
+		if c.breaker != nil {
+			if token, err = c.breaker.Allow(); err != nil {
+				return attempts - 1, err
 			}
+		}
 
-			reply := new(pb.BasicMessage)
-			if err := proto.Unmarshal(data, reply); err != nil {
-				return err
-			}
+		var reply *pb.BasicMessage
+		reply, err = c.attempt(message, policy.AttemptTimeout(attempts))
+		if c.breaker != nil {
+			c.breaker.Record(token, err)
+		}
 
-			info("received: %s\n", reply.String())
-			return nil
+		if err == nil {
+			return attempts, nil
+		}
 
-		} else if retries--; retries == 0 {
-			warn("connection to %s is offline, message dropped", c.addr)
-			if err := c.Reset(); err != nil {
-				return err
+		// Old socket is confused after a timeout, reset it.
+		if errors.Is(err, ErrRequestTimeout) {
+			c.outcomes.Timeouts++
+			if rerr := c.Reset(); rerr != nil {
+				return attempts, rerr
 			}
-			return nil
-		} else {
-			warn("no response from server, retrying send")
+			c.outcomes.Resets++
+		}
 
-			// Old socket is confused, reset it.
-			if err := c.Reset(); err != nil {
-				return err
+		if !policy.Retry(attempts, err) {
+			break
+		}
+
+		// Back off before the next attempt, for at least as long as the
+		// server requested if the client was rate limited.
+		wait := policy.Backoff(attempts)
+		if errors.Is(err, ErrRateLimited) {
+			if hint, perr := time.ParseDuration(reply.Message); perr == nil && hint > wait {
+				wait = hint
 			}
+		}
+
+		warn("%s, retrying send in %s", err, wait)
+		time.Sleep(wait)
+	}
+
+	if errors.Is(err, ErrRequestTimeout) {
+		return attempts, WrapError("connection to %s is offline", ErrMessageDropped, c.addr)
+	}
+	return attempts, err
+}
+
+// Sessions requests the table of active client sessions from the server,
+// waiting at most timeout for the reply.
+func (c *Client) Sessions(timeout time.Duration) ([]*Session, error) {
+	err := c.transmit(&pb.BasicMessage{
+		Sender:     c.name,
+		Type:       pb.Type_SESSIONS,
+		Deadline:   time.Now().Add(timeout).UnixNano(),
+		Identity:   c.identity,
+		Connection: c.conn,
+	})
+	if err != nil {
+		return nil, err
+	}
 
-			// Resend the original message
-			if err := c.send(message); err != nil {
-				return err
+	reply, err := c.await(timeout)
+	if err != nil {
+		if errors.Is(err, ErrRequestTimeout) {
+			if rerr := c.Reset(); rerr != nil {
+				return nil, rerr
 			}
 		}
+		return nil, err
+	}
+
+	var sessions []*Session
+	if err = json.Unmarshal([]byte(reply.Message), &sessions); err != nil {
+		return nil, WrapError("could not parse sessions", err)
+	}
+	return sessions, nil
+}
+
+// Send a single request and poll the socket for a reply until the timeout,
+// returning ErrRequestTimeout if no reply is received.
+func (c *Client) attempt(message string, timeout time.Duration) (*pb.BasicMessage, error) {
+	if err := c.request(message, time.Now().Add(timeout)); err != nil {
+		return nil, err
 	}
+	return c.await(timeout)
+}
+
+// Wait for the reply to the request that was just sent until the timeout,
+// verifying it and converting error replies into errors.
+func (c *Client) await(timeout time.Duration) (*pb.BasicMessage, error) {
+	// Poll socket for a reply, with timeout
+	poller := zmq.NewPoller()
+	poller.Add(c.sock, zmq.POLLIN)
+	sockets, err := poller.PollAll(timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if sockets[0].Events&zmq.POLLIN == 0 {
+		return nil, ErrRequestTimeout
+	}
+
+	data, err := c.sock.RecvBytes(0)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := new(pb.BasicMessage)
+	if err := proto.Unmarshal(data, reply); err != nil {
+		return nil, err
+	}
+
+	// Verify the reply if the client requires signatures
+	if c.signer != nil {
+		if err := c.signer.Verify(reply); err != nil {
+			return reply, WrapError("could not verify reply from %s", err, reply.Sender)
+		}
+	}
+
+	info("received: %s\n", reply.String())
+	return reply, replyError(reply)
 }
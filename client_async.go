@@ -0,0 +1,449 @@
+package rtreq
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+
+	pb "github.com/bbengfort/rtreq/msg"
+	"github.com/bbengfort/x/stats"
+	"github.com/gogo/protobuf/proto"
+	zmq "github.com/pebbe/zmq4"
+)
+
+// AsyncTick is the longest the async client waits on its sockets before it
+// checks outstanding requests for timeouts, which bounds the precision of
+// per-request timeouts.
+const AsyncTick = 10 * time.Millisecond
+
+// NewAsyncClient creates a new rtreq.AsyncClient. If context is nil, it also
+// creates a context that will be managed by the client.
+func NewAsyncClient(addr, name string, context *zmq.Context) (c *AsyncClient, err error) {
+	if context == nil {
+		if context, err = zmq.NewContext(); err != nil {
+			return nil, WrapError("could not create zmq context", err)
+		}
+	}
+
+	c = new(AsyncClient)
+	c.Init(addr, name, context)
+	return c, nil
+}
+
+//===========================================================================
+// Asynchronous Client Transporter
+//===========================================================================
+
+// AsyncClient communicates with a server using a DEALER socket so that many
+// requests may be outstanding at once. Replies are matched to requests by
+// id and delivered through futures. The DEALER socket is owned by a go
+// routine that is started on connect; requests are queued to it on an in
+// process socket, so the client may be used by multiple go routines.
+type AsyncClient struct {
+	sync.Mutex
+	Transporter
+	nextID   uint64             // the id of the last request
+	pending  map[uint64]*Future // outstanding requests by id
+	queue    *zmq.Socket        // PUSH socket that queues requests (guarded by sending)
+	sending  sync.Mutex         // guards the queue so requests are sent without the lock
+	closing  sync.Once          // ensures the client is only closed once
+	inbox    *zmq.Socket        // PULL socket the go routine receives requests on
+	stop     chan struct{}      // closed to stop the socket go routine
+	done     chan error         // receives the result of the socket go routine
+	messages uint64             // number of messages sent to measure throughput
+	latency  time.Duration      // total time to send messages for throughput
+	stats    *stats.Statistics  // distribution of message latency
+	hist     *Histogram         // histogram of message latency for percentiles
+	outcomes Outcomes           // counts of timeouts and failed requests
+	sampler  *Sampler           // time series of the benchmark, if sampled
+	window   window             // requests recorded by the benchmark
+	requests *requestStream     // requests sent by benchmarks, default if nil
+	elapsed  time.Duration      // wall-clock duration of the benchmark
+}
+
+// Connect to the remote peer and start the go routine that sends queued
+// requests and receives replies.
+func (c *AsyncClient) Connect() (err error) {
+	// Create the socket
+	if c.sock, err = c.context.NewSocket(zmq.DEALER); err != nil {
+		return err
+	}
+
+	// Create an identity for the client if it does not have one
+	if c.identity == "" {
+		c.identity = newIdentity(c.name)
+	}
+	c.conn = newConnectionID()
+	c.sock.SetIdentity(c.identity)
+
+	// Configure CURVE security if required
+	if c.security != nil {
+		if err = c.security.Client(c.sock); err != nil {
+			return err
+		}
+	}
+
+	// Connect to the server
+	if err = c.sock.Connect(c.addr); err != nil {
+		return err
+	}
+
+	// Create the in process queue to pass requests to the socket go routine
+	endpoint := fmt.Sprintf("inproc://rtreq-async-%p", c)
+	if c.inbox, err = c.context.NewSocket(zmq.PULL); err != nil {
+		return err
+	}
+
+	if err = c.inbox.Bind(endpoint); err != nil {
+		return WrapError("could not bind '%s'", err, endpoint)
+	}
+
+	if c.queue, err = c.context.NewSocket(zmq.PUSH); err != nil {
+		return err
+	}
+
+	if err = c.queue.Connect(endpoint); err != nil {
+		return WrapError("could not connect to '%s'", err, endpoint)
+	}
+
+	c.pending = make(map[uint64]*Future)
+	c.stop = make(chan struct{})
+	c.done = make(chan error, 1)
+	go func() { c.done <- c.run() }()
+
+	info("connected to %s\n", c.addr)
+	return nil
+}
+
+// Close the client, failing any outstanding requests, and wait for the
+// socket go routine to exit. Closing the client more than once is a no-op,
+// and closing a client that did not connect closes any sockets it created.
+func (c *AsyncClient) Close() (err error) {
+	c.closing.Do(func() {
+		if c.stop == nil {
+			err = c.closeSockets()
+			return
+		}
+
+		c.Lock()
+		close(c.stop)
+		c.Unlock()
+
+		c.sending.Lock()
+		defer c.sending.Unlock()
+		c.queue.SendBytes(nil, zmq.DONTWAIT)
+
+		err = <-c.done
+		c.queue.SetLinger(0)
+		if cerr := c.queue.Close(); err == nil {
+			err = cerr
+		}
+	})
+	return err
+}
+
+// Close the sockets created by a connect that failed before the socket go
+// routine was started.
+func (c *AsyncClient) closeSockets() error {
+	for _, sock := range []*zmq.Socket{c.queue, c.inbox} {
+		if sock != nil {
+			sock.SetLinger(0)
+			sock.Close()
+		}
+	}
+	return c.Transporter.Close()
+}
+
+// SetWorkload specifies the mix of requests the client sends when it is
+// benchmarked; if nil, small numbered messages are sent.
+func (c *AsyncClient) SetWorkload(workload *Workload) {
+	c.Lock()
+	defer c.Unlock()
+	c.requests = workload.stream(0)
+}
+
+//===========================================================================
+// Transport Methods
+//===========================================================================
+
+// Request queues a message to be sent to the server, returning a future for
+// the reply. If the reply is not received before the timeout, the future is
+// resolved with ErrRequestTimeout. If callback is not nil, it is called from
+// the socket go routine when the future is resolved and must not block.
+func (c *AsyncClient) Request(message string, timeout time.Duration, callback func(*Future)) *Future {
+	future := &Future{Sent: time.Now(), callback: callback, done: make(chan struct{})}
+	future.deadline = future.Sent.Add(timeout)
+
+	if err := c.enqueue(future, message); err != nil {
+		future.resolve(nil, err)
+	}
+	return future
+}
+
+// Assign the future an id, register it as pending and queue the request.
+// The request is queued without holding the lock, since the socket go
+// routine requires the lock to resolve futures while the queue is full.
+func (c *AsyncClient) enqueue(future *Future, message string) error {
+	c.Lock()
+	if c.stop == nil {
+		c.Unlock()
+		return ErrClientClosed
+	}
+
+	select {
+	case <-c.stop:
+		c.Unlock()
+		return ErrClientClosed
+	default:
+	}
+
+	c.nextID++
+	future.ID = c.nextID
+
+	data, err := c.marshal(&pb.BasicMessage{
+		Sender:     c.name,
+		Message:    message,
+		Deadline:   future.deadline.UnixNano(),
+		Id:         future.ID,
+		Identity:   c.identity,
+		Connection: c.conn,
+	})
+	if err != nil {
+		c.Unlock()
+		return err
+	}
+
+	c.pending[future.ID] = future
+	c.Unlock()
+
+	if err = c.send(data); err != nil {
+		// If the request is no longer pending it has already been resolved
+		c.Lock()
+		_, ok := c.pending[future.ID]
+		delete(c.pending, future.ID)
+		c.Unlock()
+
+		if ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// Queue a request to the socket go routine, waiting for room in the queue
+// until the client is closed.
+func (c *AsyncClient) send(data []byte) error {
+	c.sending.Lock()
+	defer c.sending.Unlock()
+
+	poller := zmq.NewPoller()
+	poller.Add(c.queue, zmq.POLLOUT)
+
+	for {
+		select {
+		case <-c.stop:
+			return ErrClientClosed
+		default:
+		}
+
+		_, err := c.queue.SendBytes(data, zmq.DONTWAIT)
+		if err == nil || zmq.AsErrno(err) != zmq.Errno(syscall.EAGAIN) {
+			return err
+		}
+
+		if _, err = poller.Poll(AsyncTick); err != nil {
+			return err
+		}
+	}
+}
+
+// Forward queued requests to the server and match replies to futures until
+// the client is closed, checking outstanding requests for timeouts.
+func (c *AsyncClient) run() (err error) {
+	defer c.inbox.Close()
+	defer c.Transporter.Close()
+	defer func() { c.fail(ErrClientClosed) }()
+
+	poller := zmq.NewPoller()
+	poller.Add(c.sock, zmq.POLLIN)
+	poller.Add(c.inbox, zmq.POLLIN)
+
+	for {
+		polled, err := poller.Poll(AsyncTick)
+		if err != nil {
+			return err
+		}
+
+		for _, item := range polled {
+			switch item.Socket {
+			case c.inbox:
+				data, err := c.inbox.RecvBytes(0)
+				if err != nil || len(data) == 0 {
+					continue
+				}
+
+				// Send the request with an empty delimiter like a REQ socket
+				nbytes, err := c.sock.SendMessage("", data)
+				if err != nil {
+					warn("could not send request: %s", err)
+					continue
+				}
+
+				c.metrics.Complete()
+				c.nBytes += uint64(nbytes)
+				c.nSent++
+			case c.sock:
+				frames, err := c.sock.RecvMessageBytes(0)
+				if err != nil {
+					warn("could not receive reply: %s", err)
+					continue
+				}
+				c.receive(frames[len(frames)-1])
+			}
+		}
+
+		select {
+		case <-c.stop:
+			return nil
+		default:
+			c.timeouts(time.Now())
+		}
+	}
+}
+
+// Parse a reply and resolve the future of the request it matches.
+func (c *AsyncClient) receive(data []byte) {
+	reply := new(pb.BasicMessage)
+	if err := proto.Unmarshal(data, reply); err != nil {
+		warn("could not parse reply: %s", err)
+		return
+	}
+	c.nRecv++
+
+	c.Lock()
+	future, ok := c.pending[reply.Id]
+	delete(c.pending, reply.Id)
+	c.Unlock()
+
+	if !ok {
+		debug("received reply to unknown or timed out request %d", reply.Id)
+		return
+	}
+
+	// Verify the reply if the client requires signatures
+	if c.signer != nil {
+		if err := c.signer.Verify(reply); err != nil {
+			future.resolve(reply, WrapError("could not verify reply from %s", err, reply.Sender))
+			return
+		}
+	}
+
+	info("received: %s\n", reply.String())
+	future.resolve(reply, replyError(reply))
+}
+
+// Resolve all requests whose deadline has passed with a timeout error.
+func (c *AsyncClient) timeouts(now time.Time) {
+	var expired []*Future
+
+	c.Lock()
+	for id, future := range c.pending {
+		if now.After(future.deadline) {
+			expired = append(expired, future)
+			delete(c.pending, id)
+		}
+	}
+	c.Unlock()
+
+	for _, future := range expired {
+		future.resolve(nil, ErrRequestTimeout)
+	}
+}
+
+// Resolve all outstanding requests with the specified error.
+func (c *AsyncClient) fail(err error) {
+	c.Lock()
+	pending := c.pending
+	c.pending = make(map[uint64]*Future)
+	c.Unlock()
+
+	for _, future := range pending {
+		future.resolve(nil, err)
+	}
+}
+
+//===========================================================================
+// Futures
+//===========================================================================
+
+// Future is the eventual reply to an asynchronous request.
+type Future struct {
+	ID       uint64           // the id of the request
+	Sent     time.Time        // the time the request was made
+	deadline time.Time        // the time after which the request times out
+	callback func(*Future)    // called when the future is resolved
+	done     chan struct{}    // closed when the future is resolved
+	reply    *pb.BasicMessage // the reply from the server
+	err      error            // the error if the request failed
+	latency  time.Duration    // time between the request and its resolution
+}
+
+// Done returns a channel that is closed when the future is resolved.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait blocks until the future is resolved and returns the reply or error.
+func (f *Future) Wait() (*pb.BasicMessage, error) {
+	<-f.done
+	return f.reply, f.err
+}
+
+// Reply returns the reply from the server, nil if not yet resolved.
+func (f *Future) Reply() *pb.BasicMessage {
+	if !f.resolved() {
+		return nil
+	}
+	return f.reply
+}
+
+// Err returns the error of the request, nil if not resolved or successful.
+func (f *Future) Err() error {
+	if !f.resolved() {
+		return nil
+	}
+	return f.err
+}
+
+// Latency returns the time between the request and its resolution, zero if
+// not yet resolved.
+func (f *Future) Latency() time.Duration {
+	if !f.resolved() {
+		return 0
+	}
+	return f.latency
+}
+
+// Returns true if the future has been resolved. The results of the future
+// may only be read once it is resolved, since they are written when it is.
+func (f *Future) resolved() bool {
+	select {
+	case <-f.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Resolve the future with the reply or error and call the callback.
+func (f *Future) resolve(reply *pb.BasicMessage, err error) {
+	f.latency = time.Since(f.Sent)
+	f.reply = reply
+	f.err = err
+	close(f.done)
+
+	if f.callback != nil {
+		f.callback(f)
+	}
+}
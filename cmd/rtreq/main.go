@@ -1,9 +1,13 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand"
 	"os"
+	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/bbengfort/rtreq"
@@ -61,6 +65,66 @@ func main() {
 					Usage: "path to write metrics out to",
                     Value: "metrics.json",
 				},
+				cli.StringFlag{
+					Name:  "rate",
+					Usage: "default per-client rate limit as msgs/sec[:burst] in async mode",
+				},
+				cli.StringSliceFlag{
+					Name:  "limit",
+					Usage: "override a client's rate limit as client=msgs/sec[:burst] (repeatable)",
+				},
+				cli.StringFlag{
+					Name:  "notify",
+					Usage: "address to bind to send notifications to clients",
+				},
+				cli.BoolFlag{
+					Name:  "pubsub",
+					Usage: "run the publish/subscribe service",
+				},
+				cli.StringFlag{
+					Name:  "pub-addr",
+					Usage: "address to bind for publishers to connect to",
+					Value: rtreq.DefaultPublishAddr,
+				},
+				cli.StringFlag{
+					Name:  "sub-addr",
+					Usage: "address to bind for subscribers to connect to",
+					Value: rtreq.DefaultSubscribeAddr,
+				},
+				cli.StringFlag{
+					Name:  "session-timeout",
+					Usage: "idle time after which a client session is forgotten",
+					Value: rtreq.DefaultSessionTimeout.String(),
+				},
+				cli.StringFlag{
+					Name:  "k, curve-key",
+					Usage: "path to the server secret key to enable CURVE",
+				},
+				cli.StringFlag{
+					Name:  "curve-clients",
+					Usage: "directory of public keys of clients allowed to connect",
+				},
+				cli.StringSliceFlag{
+					Name:  "allow",
+					Usage: "IP address or network allowed to connect (repeatable)",
+				},
+				cli.StringSliceFlag{
+					Name:  "deny",
+					Usage: "IP address or network denied from connecting (repeatable)",
+				},
+				cli.StringFlag{
+					Name:  "passwords",
+					Usage: "path to username:password file to require PLAIN authentication",
+				},
+				cli.StringFlag{
+					Name:  "hmac-secret",
+					Usage: "path to a shared secret to sign and verify messages",
+				},
+				cli.StringFlag{
+					Name:  "hmac-window",
+					Usage: "maximum clock difference allowed for signed messages",
+					Value: rtreq.DefaultSignatureWindow.String(),
+				},
 				cli.UintFlag{
 					Name:  "verbosity",
 					Usage: "set log level from 0-4, lower is more verbose",
@@ -90,8 +154,79 @@ func main() {
 				},
 				cli.IntFlag{
 					Name:  "r, retries",
-					Usage: "number of retries before quitting",
-					Value: 3,
+					Usage: "maximum number of attempts before quitting",
+					Value: rtreq.DefaultMaxAttempts,
+				},
+				cli.StringFlag{
+					Name:  "backoff",
+					Usage: "initial backoff between retries, doubled after each retry",
+					Value: rtreq.DefaultBaseBackoff.String(),
+				},
+				cli.StringFlag{
+					Name:  "max-backoff",
+					Usage: "maximum backoff between retries",
+					Value: rtreq.DefaultMaxBackoff.String(),
+				},
+				cli.Float64Flag{
+					Name:  "jitter",
+					Usage: "fraction of the backoff to randomize",
+					Value: rtreq.DefaultJitter,
+				},
+				cli.Float64Flag{
+					Name:  "timeout-growth",
+					Usage: "factor to grow the timeout by after each attempt",
+					Value: 1.0,
+				},
+				cli.StringFlag{
+					Name:  "retry-on",
+					Usage: "comma separated errors to retry: timeout, rate-limited, unavailable, expired, all",
+					Value: "timeout,rate-limited,unavailable",
+				},
+				cli.IntFlag{
+					Name:  "breaker-threshold",
+					Usage: "consecutive failures that open the circuit breaker (0 disables it)",
+				},
+				cli.StringFlag{
+					Name:  "breaker-cooldown",
+					Usage: "time the circuit breaker stays open before a trial request",
+					Value: rtreq.DefaultBreakerCooldown.String(),
+				},
+				cli.StringFlag{
+					Name:  "heartbeat",
+					Usage: "interval to send heartbeats to the server (0 disables them)",
+					Value: "0s",
+				},
+				cli.IntFlag{
+					Name:  "heartbeat-liveness",
+					Usage: "missed heartbeats before requests to the server fail fast",
+					Value: rtreq.DefaultHeartbeatLiveness,
+				},
+				cli.StringFlag{
+					Name:  "k, curve-key",
+					Usage: "path to the client secret key to enable CURVE",
+				},
+				cli.StringFlag{
+					Name:  "curve-server",
+					Usage: "path to the public key of the server",
+				},
+				cli.StringFlag{
+					Name:   "username",
+					Usage:  "username for PLAIN authentication",
+					EnvVar: "RTREQ_USERNAME",
+				},
+				cli.StringFlag{
+					Name:   "password",
+					Usage:  "password for PLAIN authentication",
+					EnvVar: "RTREQ_PASSWORD",
+				},
+				cli.StringFlag{
+					Name:  "hmac-secret",
+					Usage: "path to a shared secret to sign and verify messages",
+				},
+				cli.StringFlag{
+					Name:  "hmac-window",
+					Usage: "maximum clock difference allowed for signed messages",
+					Value: rtreq.DefaultSignatureWindow.String(),
 				},
 			},
 		},
@@ -115,6 +250,78 @@ func main() {
 					Usage: "parsable duration of the benchmark",
 					Value: "30s",
 				},
+				cli.StringFlag{
+					Name:  "warmup",
+					Usage: "duration to send requests before measuring them",
+					Value: "0s",
+				},
+				cli.StringFlag{
+					Name:  "cooldown",
+					Usage: "duration to send requests after measuring them",
+					Value: "0s",
+				},
+				cli.StringFlag{
+					Name:  "interval",
+					Usage: "interval to report progress and sample results (0 disables sampling)",
+					Value: rtreq.DefaultSampleInterval.String(),
+				},
+				cli.StringFlag{
+					Name:  "payload",
+					Usage: "payload size in bytes: N, uniform:MIN:MAX, normal:MEAN:STDDEV or exponential:MEAN",
+				},
+				cli.StringFlag{
+					Name:  "mix",
+					Usage: "weighted mix of requests as NAME:WEIGHT:PAYLOAD,... (overrides payload)",
+				},
+				cli.BoolFlag{
+					Name:  "sweep",
+					Usage: "increase the open-loop rate from --rate until the objective is violated",
+				},
+				cli.Float64Flag{
+					Name:  "sweep-growth",
+					Usage: "factor to increase the rate by after each sustainable step",
+					Value: rtreq.DefaultSweepGrowth,
+				},
+				cli.IntFlag{
+					Name:  "sweep-steps",
+					Usage: "maximum number of steps to increase, or if the first step is not sustainable decrease, the rate",
+					Value: rtreq.DefaultSweepSteps,
+				},
+				cli.IntFlag{
+					Name:  "sweep-refine",
+					Usage: "number of steps to bisect the knee after the objective is violated",
+					Value: rtreq.DefaultSweepRefinements,
+				},
+				cli.Float64Flag{
+					Name:  "slo-percentile",
+					Usage: "latency percentile the objective applies to",
+					Value: rtreq.DefaultSLOPercentile,
+				},
+				cli.StringFlag{
+					Name:  "slo-latency",
+					Usage: "maximum latency at the percentile (0 disables the check)",
+					Value: rtreq.DefaultSLOLatency.String(),
+				},
+				cli.Float64Flag{
+					Name:  "slo-errors",
+					Usage: "maximum fraction of requests that fail or time out (0 disables the check)",
+					Value: rtreq.DefaultSLOErrorRate,
+				},
+				cli.Float64Flag{
+					Name:  "slo-throughput",
+					Usage: "minimum fraction of the offered rate that must be achieved (0 disables the check)",
+					Value: rtreq.DefaultSLOThroughput,
+				},
+				cli.StringFlag{
+					Name:  "think",
+					Usage: "pause between requests of each client: DURATION, exponential:MEAN or uniform:MIN:MAX",
+					Value: "0s",
+				},
+				cli.StringFlag{
+					Name:  "ramp",
+					Usage: "start clients over a DURATION, or in groups with DURATION:STEPS",
+					Value: "0s",
+				},
 				cli.StringFlag{
 					Name:  "t, timeout",
 					Usage: "recv timeout for each message",
@@ -122,12 +329,91 @@ func main() {
 				},
 				cli.IntFlag{
 					Name:  "r, retries",
-					Usage: "number of retries before quitting",
-					Value: 3,
+					Usage: "maximum number of attempts before quitting",
+					Value: rtreq.DefaultMaxAttempts,
+				},
+				cli.StringFlag{
+					Name:  "backoff",
+					Usage: "initial backoff between retries, doubled after each retry",
+					Value: rtreq.DefaultBaseBackoff.String(),
+				},
+				cli.StringFlag{
+					Name:  "max-backoff",
+					Usage: "maximum backoff between retries",
+					Value: rtreq.DefaultMaxBackoff.String(),
+				},
+				cli.Float64Flag{
+					Name:  "jitter",
+					Usage: "fraction of the backoff to randomize",
+					Value: rtreq.DefaultJitter,
+				},
+				cli.Float64Flag{
+					Name:  "timeout-growth",
+					Usage: "factor to grow the timeout by after each attempt",
+					Value: 1.0,
+				},
+				cli.StringFlag{
+					Name:  "retry-on",
+					Usage: "comma separated errors to retry: timeout, rate-limited, unavailable, expired, all",
+					Value: "timeout,rate-limited,unavailable",
+				},
+				cli.IntFlag{
+					Name:  "breaker-threshold",
+					Usage: "consecutive failures that open the circuit breaker (0 disables it)",
+				},
+				cli.StringFlag{
+					Name:  "breaker-cooldown",
+					Usage: "time the circuit breaker stays open before a trial request",
+					Value: rtreq.DefaultBreakerCooldown.String(),
+				},
+				cli.StringFlag{
+					Name:  "heartbeat",
+					Usage: "interval to send heartbeats to the server (0 disables them)",
+					Value: "0s",
+				},
+				cli.IntFlag{
+					Name:  "heartbeat-liveness",
+					Usage: "missed heartbeats before requests to the server fail fast",
+					Value: rtreq.DefaultHeartbeatLiveness,
 				},
 				cli.IntFlag{
 					Name:  "c, clients",
-					Usage: "extra information: number of clients",
+					Usage: "number of concurrent clients, or extra information if pipelined",
+				},
+				cli.Uint64Flag{
+					Name:  "max-failures",
+					Usage: "abort after more than this many failed requests (0 for no limit)",
+				},
+				cli.Float64Flag{
+					Name:  "max-failure-rate",
+					Usage: "abort when more than this fraction of requests fail (0 for no limit)",
+				},
+				cli.Float64Flag{
+					Name:  "rate",
+					Usage: "send requests open-loop at this many msgs/sec (0 is closed-loop), or start a sweep at this rate",
+				},
+				cli.StringFlag{
+					Name:  "arrivals",
+					Usage: "spacing of open-loop requests: constant or poisson",
+					Value: "constant",
+				},
+				cli.IntFlag{
+					Name:  "fanout",
+					Usage: "benchmark publish/subscribe fan-out to this many subscribers",
+				},
+				cli.StringFlag{
+					Name:  "pub-addr",
+					Usage: "address to publish to in fan-out benchmarks",
+					Value: "localhost:4159",
+				},
+				cli.StringFlag{
+					Name:  "sub-addr",
+					Usage: "address to subscribe to in fan-out benchmarks",
+					Value: "localhost:4160",
+				},
+				cli.IntFlag{
+					Name:  "p, pipeline",
+					Usage: "number of outstanding requests using an async client",
 				},
 				cli.StringFlag{
 					Name:  "o, results",
@@ -139,6 +425,33 @@ func main() {
 					Usage: "specify random seed for the process",
 					Value: time.Now().Unix(),
 				},
+				cli.StringFlag{
+					Name:  "k, curve-key",
+					Usage: "path to the client secret key to enable CURVE",
+				},
+				cli.StringFlag{
+					Name:  "curve-server",
+					Usage: "path to the public key of the server",
+				},
+				cli.StringFlag{
+					Name:   "username",
+					Usage:  "username for PLAIN authentication",
+					EnvVar: "RTREQ_USERNAME",
+				},
+				cli.StringFlag{
+					Name:   "password",
+					Usage:  "password for PLAIN authentication",
+					EnvVar: "RTREQ_PASSWORD",
+				},
+				cli.StringFlag{
+					Name:  "hmac-secret",
+					Usage: "path to a shared secret to sign and verify messages",
+				},
+				cli.StringFlag{
+					Name:  "hmac-window",
+					Usage: "maximum clock difference allowed for signed messages",
+					Value: rtreq.DefaultSignatureWindow.String(),
+				},
 				cli.UintFlag{
 					Name:  "verbosity",
 					Usage: "set log level from 0-4, lower is more verbose",
@@ -146,6 +459,221 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:     "listen",
+			Usage:    "print notifications sent by the server",
+			Category: "client",
+			Action:   listen,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "a, addr",
+					Usage: "address to connect to the server on",
+					Value: "localhost:4157",
+				},
+				cli.StringFlag{
+					Name:  "notify",
+					Usage: "address the server sends notifications on",
+					Value: "localhost:4158",
+				},
+				cli.StringFlag{
+					Name:  "n, name",
+					Usage: "name to identify the client (default is hostname)",
+				},
+				cli.StringFlag{
+					Name:  "k, curve-key",
+					Usage: "path to the client secret key to enable CURVE",
+				},
+				cli.StringFlag{
+					Name:  "curve-server",
+					Usage: "path to the public key of the server",
+				},
+				cli.StringFlag{
+					Name:   "username",
+					Usage:  "username for PLAIN authentication",
+					EnvVar: "RTREQ_USERNAME",
+				},
+				cli.StringFlag{
+					Name:   "password",
+					Usage:  "password for PLAIN authentication",
+					EnvVar: "RTREQ_PASSWORD",
+				},
+				cli.StringFlag{
+					Name:  "hmac-secret",
+					Usage: "path to a shared secret to sign and verify messages",
+				},
+				cli.StringFlag{
+					Name:  "hmac-window",
+					Usage: "maximum clock difference allowed for signed messages",
+					Value: rtreq.DefaultSignatureWindow.String(),
+				},
+			},
+		},
+		{
+			Name:      "pub",
+			Usage:     "publish messages to a topic",
+			ArgsUsage: "message [message ...]",
+			Category:  "pubsub",
+			Action:    publish,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "a, addr",
+					Usage: "address of the server to publish to",
+					Value: "localhost:4159",
+				},
+				cli.StringFlag{
+					Name:  "n, name",
+					Usage: "name to identify the publisher (default is hostname)",
+				},
+				cli.StringFlag{
+					Name:  "t, topic",
+					Usage: "topic to publish the messages to",
+				},
+				cli.StringFlag{
+					Name:  "wait",
+					Usage: "time to wait for subscriptions before publishing",
+					Value: rtreq.DefaultJoinDelay.String(),
+				},
+				cli.StringFlag{
+					Name:  "k, curve-key",
+					Usage: "path to the client secret key to enable CURVE",
+				},
+				cli.StringFlag{
+					Name:  "curve-server",
+					Usage: "path to the public key of the server",
+				},
+				cli.StringFlag{
+					Name:   "username",
+					Usage:  "username for PLAIN authentication",
+					EnvVar: "RTREQ_USERNAME",
+				},
+				cli.StringFlag{
+					Name:   "password",
+					Usage:  "password for PLAIN authentication",
+					EnvVar: "RTREQ_PASSWORD",
+				},
+				cli.StringFlag{
+					Name:  "hmac-secret",
+					Usage: "path to a shared secret to sign and verify messages",
+				},
+				cli.StringFlag{
+					Name:  "hmac-window",
+					Usage: "maximum clock difference allowed for signed messages",
+					Value: rtreq.DefaultSignatureWindow.String(),
+				},
+			},
+		},
+		{
+			Name:      "sub",
+			Usage:     "print messages published to topics",
+			ArgsUsage: "[topic ...]",
+			Category:  "pubsub",
+			Action:    subscribe,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "a, addr",
+					Usage: "address of the server to subscribe to",
+					Value: "localhost:4160",
+				},
+				cli.StringFlag{
+					Name:  "n, name",
+					Usage: "name to identify the subscriber (default is hostname)",
+				},
+				cli.StringFlag{
+					Name:  "k, curve-key",
+					Usage: "path to the client secret key to enable CURVE",
+				},
+				cli.StringFlag{
+					Name:  "curve-server",
+					Usage: "path to the public key of the server",
+				},
+				cli.StringFlag{
+					Name:   "username",
+					Usage:  "username for PLAIN authentication",
+					EnvVar: "RTREQ_USERNAME",
+				},
+				cli.StringFlag{
+					Name:   "password",
+					Usage:  "password for PLAIN authentication",
+					EnvVar: "RTREQ_PASSWORD",
+				},
+				cli.StringFlag{
+					Name:  "hmac-secret",
+					Usage: "path to a shared secret to sign and verify messages",
+				},
+				cli.StringFlag{
+					Name:  "hmac-window",
+					Usage: "maximum clock difference allowed for signed messages",
+					Value: rtreq.DefaultSignatureWindow.String(),
+				},
+			},
+		},
+		{
+			Name:     "sessions",
+			Usage:    "list the active client sessions of a server",
+			Category: "admin",
+			Action:   sessions,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "a, addr",
+					Usage: "address to connect to the server on",
+					Value: "localhost:4157",
+				},
+				cli.StringFlag{
+					Name:  "n, name",
+					Usage: "name to identify the client (default is hostname)",
+				},
+				cli.StringFlag{
+					Name:  "t, timeout",
+					Usage: "time to wait for the server to reply",
+					Value: "5s",
+				},
+				cli.BoolFlag{
+					Name:  "j, json",
+					Usage: "print the session table as JSON",
+				},
+				cli.StringFlag{
+					Name:  "k, curve-key",
+					Usage: "path to the client secret key to enable CURVE",
+				},
+				cli.StringFlag{
+					Name:  "curve-server",
+					Usage: "path to the public key of the server",
+				},
+				cli.StringFlag{
+					Name:   "username",
+					Usage:  "username for PLAIN authentication",
+					EnvVar: "RTREQ_USERNAME",
+				},
+				cli.StringFlag{
+					Name:   "password",
+					Usage:  "password for PLAIN authentication",
+					EnvVar: "RTREQ_PASSWORD",
+				},
+				cli.StringFlag{
+					Name:  "hmac-secret",
+					Usage: "path to a shared secret to sign and verify messages",
+				},
+				cli.StringFlag{
+					Name:  "hmac-window",
+					Usage: "maximum clock difference allowed for signed messages",
+					Value: rtreq.DefaultSignatureWindow.String(),
+				},
+			},
+		},
+		{
+			Name:      "keygen",
+			Usage:     "generate CURVE key pairs for servers and clients",
+			ArgsUsage: "name [name ...]",
+			Category:  "security",
+			Action:    keygen,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "o, outdir",
+					Usage: "directory to write the key files to",
+					Value: ".",
+				},
+			},
+		},
 	}
 
 	// Run the CLI program
@@ -179,6 +707,40 @@ func serve(c *cli.Context) error {
 		return exit("could not initialize server", err)
 	}
 
+	// Configure security and authentication if specified
+	if err = secureServer(c, server); err != nil {
+		return exit("could not configure security", err)
+	}
+
+	// Configure message signatures if specified
+	if signer, err := loadSigner(c); err != nil {
+		return exit("could not configure signatures", err)
+	} else if signer != nil {
+		server.SetSigner(signer)
+	}
+
+	// Configure per-client rate limits if specified
+	if err = rateLimits(c, server); err != nil {
+		return exit("could not configure rate limits", err)
+	}
+
+	// Send notifications to clients if an address is specified
+	if notify := c.String("notify"); notify != "" {
+		server.SetNotifications(notify)
+	}
+
+	// Run the publish/subscribe service if specified
+	if c.Bool("pubsub") {
+		server.SetPubSub(c.String("pub-addr"), c.String("sub-addr"))
+	}
+
+	// Configure how long idle client sessions are kept
+	timeout, err := time.ParseDuration(c.String("session-timeout"))
+	if err != nil {
+		return exit("could not parse session timeout", err)
+	}
+	server.SetSessionTimeout(timeout)
+
 	// Defer the shutdown
 	defer server.Shutdown(c.String("outpath"))
 
@@ -202,68 +764,655 @@ func serve(c *cli.Context) error {
 	return nil
 }
 
-//===========================================================================
-// Client Commands
-//===========================================================================
+// Configure CURVE security if a server key is specified, along with any IP
+// allow or deny lists and PLAIN credentials.
+func secureServer(c *cli.Context, server rtreq.Server) (err error) {
+	security := new(rtreq.Security)
+	if key := c.String("curve-key"); key != "" {
+		if security, err = rtreq.NewServerSecurity(key, c.String("curve-clients")); err != nil {
+			return err
+		}
+	}
 
-func send(c *cli.Context) error {
-	client, err := rtreq.NewClient(c.String("addr"), c.String("name"), nil)
-	if err != nil {
+	security.Allow = c.StringSlice("allow")
+	security.Deny = c.StringSlice("deny")
+	security.Passwords = c.String("passwords")
+
+	if security.Keys != nil && security.Passwords != "" {
+		return errors.New("--curve-key and --passwords cannot be used together")
+	}
+
+	if security.Keys == nil && security.Passwords == "" && len(security.Allow) == 0 && len(security.Deny) == 0 {
+		return nil
+	}
+
+	server.SetSecurity(security)
+	return nil
+}
+
+// Configure the default rate limit and any client overrides on the server.
+func rateLimits(c *cli.Context, server rtreq.Server) error {
+	if c.String("rate") == "" && len(c.StringSlice("limit")) == 0 {
+		return nil
+	}
+
+	router, ok := server.(*rtreq.RouterServer)
+	if !ok {
+		return errors.New("rate limits can only be applied in async mode")
+	}
+
+	var defaults rtreq.RateLimit
+	if rate := c.String("rate"); rate != "" {
+		var err error
+		if defaults, err = rtreq.ParseRateLimit(rate); err != nil {
+			return err
+		}
+	}
+
+	limiter := rtreq.NewRateLimiter(defaults)
+	for _, override := range c.StringSlice("limit") {
+		parts := strings.SplitN(override, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("could not parse limit '%s'", override)
+		}
+
+		limit, err := rtreq.ParseRateLimit(parts[1])
+		if err != nil {
+			return err
+		}
+		limiter.Override(parts[0], limit)
+	}
+
+	router.SetRateLimiter(limiter)
+	return nil
+}
+
+//===========================================================================
+// Client Commands
+//===========================================================================
+
+func send(c *cli.Context) error {
+	client, err := rtreq.NewClient(c.String("addr"), c.String("name"), nil)
+	if err != nil {
 		return exit("could not create client", err)
 	}
 	defer client.Shutdown()
 
+	if err = secureClient(c, client); err != nil {
+		return exit("could not configure security", err)
+	}
+
+	if err = circuitBreaker(c, client); err != nil {
+		return exit("could not configure circuit breaker", err)
+	}
+
 	if err = client.Connect(); err != nil {
 		return exit("", err)
 	}
 
-	var timeout time.Duration
-	if timeout, err = time.ParseDuration(c.String("timeout")); err != nil {
+	if err = heartbeat(c, client); err != nil {
+		return exit("could not start heartbeats", err)
+	}
+
+	var policy *rtreq.RetryPolicy
+	if policy, err = retryPolicy(c); err != nil {
 		return exit("", err)
 	}
 
 	for _, msg := range c.Args() {
-		if err := client.Send(msg, c.Int("retries"), timeout); err != nil {
-			exit("", err)
+		if err := client.Send(msg, policy); err != nil {
+			return exit("could not send message", err)
 		}
 	}
 
 	return client.Close()
 }
 
-func bench(c *cli.Context) error {
-
-	// Set the debug log level
-	verbose := c.Uint("verbosity")
-	rtreq.SetLogLevel(uint8(verbose))
-
-	// Set the random seed
-	rand.Seed(c.Int64("seed"))
-
+func listen(c *cli.Context) error {
 	client, err := rtreq.NewClient(c.String("addr"), c.String("name"), nil)
 	if err != nil {
 		return exit("could not create client", err)
 	}
 	defer client.Shutdown()
 
+	if err = secureClient(c, client); err != nil {
+		return exit("could not configure security", err)
+	}
+
 	if err = client.Connect(); err != nil {
 		return exit("", err)
 	}
 	defer client.Close()
 
+	notifications, err := client.Subscribe(c.String("notify"))
+	if err != nil {
+		return exit("could not subscribe to notifications", err)
+	}
+
+	fmt.Printf("listening for notifications as %s\n", client.Identity())
+	for msg := range notifications {
+		scope := "broadcast"
+		if msg.Identity != "" {
+			scope = "direct"
+		}
+
+		ts := time.Unix(0, msg.Timestamp).Format(time.RFC3339)
+		fmt.Printf("[%s] %s (%s): %s\n", ts, msg.Sender, scope, msg.Message)
+	}
+	return nil
+}
+
+func bench(c *cli.Context) (err error) {
+
+	// Set the debug log level
+	verbose := c.Uint("verbosity")
+	rtreq.SetLogLevel(uint8(verbose))
+
+	// Set the random seed
+	rand.Seed(c.Int64("seed"))
+
 	var duration time.Duration
 	if duration, err = time.ParseDuration(c.String("duration")); err != nil {
 		return exit("", err)
 	}
 
+	var phases rtreq.Phases
+	if phases.Warmup, err = time.ParseDuration(c.String("warmup")); err != nil {
+		return exit("could not parse warmup", err)
+	}
+
+	if phases.Cooldown, err = time.ParseDuration(c.String("cooldown")); err != nil {
+		return exit("could not parse cooldown", err)
+	}
+
+	var sampleInterval time.Duration
+	if sampleInterval, err = time.ParseDuration(c.String("interval")); err != nil {
+		return exit("could not parse sample interval", err)
+	}
+
+	var sampler *rtreq.Sampler
+	if sampleInterval > 0 {
+		sampler = rtreq.NewSampler(sampleInterval)
+	}
+
+	var workload *rtreq.Workload
+	if workload, err = benchWorkload(c); err != nil {
+		return exit("could not create workload", err)
+	}
+
 	var timeout time.Duration
 	if timeout, err = time.ParseDuration(c.String("timeout")); err != nil {
 		return exit("", err)
 	}
 
+	var policy *rtreq.RetryPolicy
+	if policy, err = retryPolicy(c); err != nil {
+		return exit("", err)
+	}
+
 	nClients := c.Int("clients")
-	retries := c.Int("retries")
 	results := c.String("results")
+	budget := errorBudget(c)
+
+	var think rtreq.ThinkTime
+	if think, err = rtreq.ParseThinkTime(c.String("think")); err != nil {
+		return exit("", err)
+	}
+
+	var ramp rtreq.Ramp
+	if ramp, err = rtreq.ParseRamp(c.String("ramp")); err != nil {
+		return exit("", err)
+	}
+
+	// Think time and ramps only apply to the closed-loop clients of the pool
+	openLoop := c.Float64("rate") > 0 || c.Bool("sweep")
+	if (think != rtreq.ThinkTime{} || ramp != rtreq.Ramp{}) && (openLoop || c.Int("pipeline") > 0) {
+		return exit("", errors.New("--think and --ramp cannot be used with --rate, --sweep or --pipeline"))
+	}
+
+	// Retries, circuit breakers and heartbeats are also only used by the pool
+	if openLoop || c.Int("pipeline") > 0 {
+		for _, flag := range []string{
+			"retries", "backoff", "max-backoff", "jitter", "timeout-growth", "retry-on",
+			"breaker-threshold", "breaker-cooldown", "heartbeat", "heartbeat-liveness",
+		} {
+			if c.IsSet(flag) {
+				return exit("", fmt.Errorf("--%s cannot be used with --rate, --sweep or --pipeline", flag))
+			}
+		}
+	}
+
+	// Benchmark publish/subscribe fan-out if subscribers are specified
+	if fanout := c.Int("fanout"); fanout > 0 {
+		pub, err := rtreq.NewPublisher(c.String("pub-addr"), c.String("name"), nil)
+		if err != nil {
+			return exit("could not create publisher", err)
+		}
+		defer pub.Shutdown()
+
+		if err = secureClient(c, pub); err != nil {
+			return exit("could not configure security", err)
+		}
+
+		if err = pub.Connect(); err != nil {
+			return exit("", err)
+		}
+		defer pub.Close()
+
+		return pub.Benchmark(duration, results, c.String("sub-addr"), fanout)
+	}
+
+	// Generate open-loop load at a fixed rate with the async client, or at
+	// increasing rates from the rate if sweeping for the saturation point
+	if openLoop {
+		rate := c.Float64("rate")
+		if rate <= 0 {
+			rate = rtreq.DefaultSweepRate
+		}
+
+		arrival, err := rtreq.ParseArrival(c.String("arrivals"))
+		if err != nil {
+			return exit("", err)
+		}
+
+		client, err := rtreq.NewAsyncClient(c.String("addr"), c.String("name"), nil)
+		if err != nil {
+			return exit("could not create client", err)
+		}
+		defer client.Shutdown()
+
+		if err = secureClient(c, client); err != nil {
+			return exit("could not configure security", err)
+		}
+
+		if err = client.Connect(); err != nil {
+			return exit("", err)
+		}
+		defer client.Close()
+
+		generator, err := rtreq.NewLoadGenerator(client, rate, arrival)
+		if err != nil {
+			return exit("", err)
+		}
+		generator.SetWorkload(workload)
+
+		if c.Bool("sweep") {
+			return sweep(c, generator, duration, phases, timeout, sampler)
+		}
+
+		if err = generator.Run(duration, phases, timeout, sampler); err != nil {
+			return exit("benchmark failed", err)
+		}
+		return generator.Results(results, nil)
+	}
+
+	// Use the async client if requests are pipelined
+	if pipeline := c.Int("pipeline"); pipeline > 0 {
+		client, err := rtreq.NewAsyncClient(c.String("addr"), c.String("name"), nil)
+		if err != nil {
+			return exit("could not create client", err)
+		}
+		defer client.Shutdown()
+
+		if err = secureClient(c, client); err != nil {
+			return exit("could not configure security", err)
+		}
+
+		if err = client.Connect(); err != nil {
+			return exit("", err)
+		}
+		defer client.Close()
+
+		client.SetWorkload(workload)
+		return client.Benchmark(duration, phases, results, timeout, budget, sampler, pipeline, nClients)
+	}
+
+	// Run each client concurrently with its own socket from a pool
+	if nClients < 1 {
+		nClients = 1
+	}
+
+	pool, err := rtreq.NewClientPool(c.String("addr"), c.String("name"), nClients, nil)
+	if err != nil {
+		return exit("could not create client pool", err)
+	}
+	defer pool.Shutdown()
+	defer pool.Close()
+
+	if err = secureClient(c, pool); err != nil {
+		return exit("could not configure security", err)
+	}
+
+	if err = circuitBreaker(c, pool); err != nil {
+		return exit("could not configure circuit breaker", err)
+	}
+
+	var interval time.Duration
+	if interval, err = time.ParseDuration(c.String("heartbeat")); err != nil {
+		return exit("could not parse heartbeat interval", err)
+	}
+	pool.SetHeartbeat(interval, c.Int("heartbeat-liveness"))
+
+	benchmark, err := rtreq.NewBenchmark(pool, nClients)
+	if err != nil {
+		return exit("", err)
+	}
+	benchmark.SetWorkload(workload)
+
+	benchmark.SetThinkTime(think)
+	benchmark.SetRamp(ramp)
+
+	if err = benchmark.Run(duration, phases, policy, budget, sampler); err != nil {
+		return exit("benchmark failed", err)
+	}
+
+	extra := map[string]interface{}{"max attempts": policy.MaxAttempts}
+	return benchmark.Results(results, extra)
+}
+
+// Search for the saturation point of the server with the load generator.
+func sweep(c *cli.Context, generator *rtreq.LoadGenerator, duration time.Duration, phases rtreq.Phases, timeout time.Duration, sampler *rtreq.Sampler) (err error) {
+	slo := rtreq.SLO{
+		Percentile: c.Float64("slo-percentile"),
+		ErrorRate:  c.Float64("slo-errors"),
+		Throughput: c.Float64("slo-throughput"),
+	}
+
+	if slo.Latency, err = time.ParseDuration(c.String("slo-latency")); err != nil {
+		return exit("could not parse latency objective", err)
+	}
 
-	return client.Benchmark(duration, results, retries, timeout, nClients)
+	search, err := rtreq.NewSweep(generator, slo, c.Float64("sweep-growth"), c.Int("sweep-steps"), c.Int("sweep-refine"))
+	if err != nil {
+		return exit("", err)
+	}
+
+	results := c.String("results")
+	if err = search.Run(duration, phases, timeout, sampler, results); err != nil {
+		return exit("sweep failed", err)
+	}
+	return search.Results(results, nil)
+}
+
+// Create the retry policy from the retries, timeout and backoff flags.
+func retryPolicy(c *cli.Context) (policy *rtreq.RetryPolicy, err error) {
+	var timeout time.Duration
+	if timeout, err = time.ParseDuration(c.String("timeout")); err != nil {
+		return nil, err
+	}
+
+	policy = rtreq.NewRetryPolicy(c.Int("retries"), timeout)
+	policy.TimeoutGrowth = c.Float64("timeout-growth")
+	policy.Jitter = c.Float64("jitter")
+
+	if policy.BaseBackoff, err = time.ParseDuration(c.String("backoff")); err != nil {
+		return nil, err
+	}
+
+	if policy.MaxBackoff, err = time.ParseDuration(c.String("max-backoff")); err != nil {
+		return nil, err
+	}
+
+	if policy.Retryable, err = rtreq.ParseRetryClasses(c.String("retry-on")); err != nil {
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+// Create the workload from the mix or payload flags, nil if neither is set
+// so that the default messages are sent.
+func benchWorkload(c *cli.Context) (*rtreq.Workload, error) {
+	seed := c.Int64("seed")
+	if mix := c.String("mix"); mix != "" {
+		return rtreq.ParseWorkload(mix, seed)
+	}
+
+	if payload := c.String("payload"); payload != "" {
+		size, err := rtreq.ParsePayloadSize(payload)
+		if err != nil {
+			return nil, err
+		}
+		return rtreq.NewWorkload(seed, &rtreq.RequestClass{Name: "default", Weight: 1, Size: size})
+	}
+	return nil, nil
+}
+
+// Create the error budget from the failure flags, nil if neither is set.
+func errorBudget(c *cli.Context) *rtreq.ErrorBudget {
+	budget := &rtreq.ErrorBudget{
+		MaxFailures:    c.Uint64("max-failures"),
+		MaxFailureRate: c.Float64("max-failure-rate"),
+	}
+
+	if budget.MaxFailures == 0 && budget.MaxFailureRate == 0 {
+		return nil
+	}
+	return budget
+}
+
+// Clients that can be configured with a circuit breaker.
+type breakable interface {
+	SetCircuitBreaker(breaker *rtreq.CircuitBreaker)
+}
+
+// Configure a circuit breaker on the client if a threshold is specified.
+func circuitBreaker(c *cli.Context, client breakable) error {
+	threshold := c.Int("breaker-threshold")
+	if threshold <= 0 {
+		return nil
+	}
+
+	cooldown, err := time.ParseDuration(c.String("breaker-cooldown"))
+	if err != nil {
+		return err
+	}
+
+	client.SetCircuitBreaker(rtreq.NewCircuitBreaker(threshold, cooldown))
+	return nil
+}
+
+// Start sending heartbeats from the client if an interval is specified.
+func heartbeat(c *cli.Context, client *rtreq.Client) error {
+	interval, err := time.ParseDuration(c.String("heartbeat"))
+	if err != nil || interval <= 0 {
+		return err
+	}
+
+	return client.StartHeartbeat(interval, c.Int("heartbeat-liveness"))
+}
+
+// Clients that can be configured with security and message signatures.
+type securable interface {
+	SetSecurity(security *rtreq.Security)
+	SetSigner(signer *rtreq.Signer)
+}
+
+// Configure CURVE security on the client if a client key is specified,
+// otherwise PLAIN authentication if a username is specified, along with
+// message signatures if a shared secret is specified.
+func secureClient(c *cli.Context, client securable) error {
+	if key := c.String("curve-key"); key != "" {
+		security, err := rtreq.NewClientSecurity(key, c.String("curve-server"))
+		if err != nil {
+			return err
+		}
+		client.SetSecurity(security)
+	} else if username := c.String("username"); username != "" {
+		client.SetSecurity(&rtreq.Security{Username: username, Password: c.String("password")})
+	}
+
+	signer, err := loadSigner(c)
+	if err != nil {
+		return err
+	}
+
+	if signer != nil {
+		client.SetSigner(signer)
+	}
+	return nil
+}
+
+// Load the shared secret to sign messages with if one is specified.
+func loadSigner(c *cli.Context) (*rtreq.Signer, error) {
+	path := c.String("hmac-secret")
+	if path == "" {
+		return nil, nil
+	}
+
+	window, err := time.ParseDuration(c.String("hmac-window"))
+	if err != nil {
+		return nil, err
+	}
+
+	return rtreq.LoadSigner(path, window)
+}
+
+//===========================================================================
+// Publish/Subscribe Commands
+//===========================================================================
+
+func publish(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return exit("", errors.New("specify at least one message to publish"))
+	}
+
+	wait, err := time.ParseDuration(c.String("wait"))
+	if err != nil {
+		return exit("", err)
+	}
+
+	pub, err := rtreq.NewPublisher(c.String("addr"), c.String("name"), nil)
+	if err != nil {
+		return exit("could not create publisher", err)
+	}
+	defer pub.Shutdown()
+
+	if err = secureClient(c, pub); err != nil {
+		return exit("could not configure security", err)
+	}
+
+	if err = pub.Connect(); err != nil {
+		return exit("", err)
+	}
+	defer pub.Close()
+
+	time.Sleep(wait)
+	for _, msg := range c.Args() {
+		if err := pub.Publish(c.String("topic"), msg); err != nil {
+			return exit("could not publish message", err)
+		}
+	}
+	return nil
+}
+
+func subscribe(c *cli.Context) error {
+	sub, err := rtreq.NewSubscriber(c.String("addr"), c.String("name"), nil)
+	if err != nil {
+		return exit("could not create subscriber", err)
+	}
+	defer sub.Shutdown()
+
+	if err = secureClient(c, sub); err != nil {
+		return exit("could not configure security", err)
+	}
+
+	if err = sub.Connect(); err != nil {
+		return exit("", err)
+	}
+	defer sub.Close()
+
+	topics := []string(c.Args())
+	if len(topics) == 0 {
+		topics = []string{""}
+	}
+
+	if err = sub.Subscribe(topics...); err != nil {
+		return exit("", err)
+	}
+
+	for {
+		topic, msg, err := sub.Recv(-1)
+		if err != nil {
+			return exit("could not receive message", err)
+		}
+		fmt.Printf("[%s] %s: %s\n", topic, msg.Sender, msg.Message)
+	}
+}
+
+//===========================================================================
+// Admin Commands
+//===========================================================================
+
+func sessions(c *cli.Context) error {
+	timeout, err := time.ParseDuration(c.String("timeout"))
+	if err != nil {
+		return exit("", err)
+	}
+
+	client, err := rtreq.NewClient(c.String("addr"), c.String("name"), nil)
+	if err != nil {
+		return exit("could not create client", err)
+	}
+	defer client.Shutdown()
+
+	if err = secureClient(c, client); err != nil {
+		return exit("could not configure security", err)
+	}
+
+	if err = client.Connect(); err != nil {
+		return exit("", err)
+	}
+	defer client.Close()
+
+	table, err := client.Sessions(timeout)
+	if err != nil {
+		return exit("could not fetch sessions", err)
+	}
+
+	if c.Bool("json") {
+		data, err := json.MarshalIndent(table, "", "  ")
+		if err != nil {
+			return exit("", err)
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "IDENTITY\tSENDER\tREQUESTS\tBYTES\tMEAN SERVICE\tFIRST SEEN\tIDLE")
+	for _, session := range table {
+		fmt.Fprintf(
+			w, "%s\t%s\t%d\t%d\t%s\t%s\t%s\n",
+			session.Identity, session.Sender, session.Requests, session.Bytes,
+			session.MeanService, session.FirstSeen.Format(time.RFC3339),
+			time.Since(session.LastSeen).Round(time.Millisecond),
+		)
+	}
+	return w.Flush()
+}
+
+//===========================================================================
+// Security Commands
+//===========================================================================
+
+func keygen(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return exit("", errors.New("specify the name of at least one key pair"))
+	}
+
+	for _, name := range c.Args() {
+		keys, err := rtreq.GenerateKeyPair()
+		if err != nil {
+			return exit("", err)
+		}
+
+		if err = keys.Write(c.String("outdir"), name); err != nil {
+			return exit("", err)
+		}
+
+		fmt.Printf("created %s key pair with public key %s\n", name, keys.Public)
+	}
+
+	return nil
 }
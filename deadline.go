@@ -0,0 +1,70 @@
+package rtreq
+
+import (
+	"context"
+	"time"
+
+	pb "github.com/bbengfort/rtreq/msg"
+)
+
+//===========================================================================
+// Request Deadlines
+//===========================================================================
+
+// Deadlines are carried in messages as absolute times in nanoseconds since
+// the epoch, so they are only accurate if the clocks of clients and servers
+// are synchronized. A zero deadline means that the request never expires.
+
+// Deadline returns the absolute deadline of the message and true, or false
+// if the message has no deadline.
+func Deadline(message *pb.BasicMessage) (time.Time, bool) {
+	if message.Deadline == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, message.Deadline), true
+}
+
+// Budget returns the time remaining before the deadline of the request
+// context passed to handlers expires, and false if there is no deadline.
+func Budget(ctx context.Context) (time.Duration, bool) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, false
+	}
+	return time.Until(deadline), true
+}
+
+// Create the context a request is handled in, which is cancelled when the
+// deadline of the request expires.
+func requestContext(message *pb.BasicMessage) (context.Context, context.CancelFunc) {
+	if deadline, ok := Deadline(message); ok {
+		return context.WithDeadline(context.Background(), deadline)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// Short-circuits a request whose deadline has already passed, replying that
+// it has expired rather than handling it since the client has abandoned it.
+// Returns true if the request was expired.
+func (t *Transporter) expire(message *pb.BasicMessage) bool {
+	deadline, ok := Deadline(message)
+	if !ok || time.Now().Before(deadline) {
+		return false
+	}
+
+	t.metrics.Expire()
+	debug("request from %s expired %s ago", message.Sender, time.Since(deadline))
+
+	reply := &pb.BasicMessage{
+		Sender: t.name,
+		Type:   pb.Type_EXPIRED,
+		Status: pb.Status_DEADLINE_EXCEEDED,
+		Error:  "request expired before it was handled",
+		Id:     message.Id,
+	}
+
+	if err := t.transmit(reply); err != nil {
+		warn("could not reply to expired request: %s", err)
+	}
+	return true
+}
@@ -11,7 +11,32 @@ import (
 
 // Standard errors for primary operations.
 var (
-	ErrNotImplemented = errors.New("functionality not implemented yet")
+	ErrNotImplemented   = errors.New("functionality not implemented yet")
+	ErrNoServerKey      = errors.New("no server public key specified")
+	ErrMixedSecurity    = errors.New("CURVE keys and PLAIN passwords cannot both be used")
+	ErrRejected         = errors.New("message rejected by server")
+	ErrRateLimited      = errors.New("client rate limited by server")
+	ErrDeadlineExceeded = errors.New("request deadline exceeded before it was handled")
+	ErrRequestTimeout   = errors.New("no reply received before the request timed out")
+	ErrClientClosed     = errors.New("client has been closed")
+	ErrPoolClosed       = errors.New("client pool has been closed")
+	ErrCircuitOpen      = errors.New("circuit breaker is open")
+	ErrServerDead       = errors.New("server is not responding to heartbeats")
+	ErrNotSubscribed    = errors.New("client is not subscribed to notifications")
+	ErrNoNotifications  = errors.New("server does not send notifications")
+	ErrNotifyQueueFull  = errors.New("notification queue is full")
+	ErrRecvTimeout      = errors.New("no message received before the timeout")
+	ErrMessageDropped   = errors.New("message dropped after every attempt timed out")
+	ErrBudgetExceeded   = errors.New("benchmark error budget exceeded")
+)
+
+// Signature errors returned when verifying messages.
+var (
+	ErrNoSecret         = errors.New("no shared secret specified")
+	ErrUnsigned         = errors.New("message is not signed")
+	ErrBadSignature     = errors.New("message signature is invalid")
+	ErrExpiredSignature = errors.New("message timestamp is outside signature window")
+	ErrReplayedMessage  = errors.New("message has already been received")
 )
 
 //===========================================================================
@@ -41,6 +66,11 @@ func (e *Error) Error() string {
 	return e.msg
 }
 
+// Unwrap returns the wrapped error so it can be inspected by errors.Is.
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
 // String returns the error message
 func (e *Error) String() string {
 	return e.Error()
@@ -0,0 +1,256 @@
+package rtreq
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/bbengfort/rtreq/msg"
+	"github.com/gogo/protobuf/proto"
+	zmq "github.com/pebbe/zmq4"
+)
+
+// Default heartbeat values used by the CLI.
+const (
+	DefaultHeartbeatInterval = time.Second
+	DefaultHeartbeatLiveness = 3
+)
+
+// HeartbeatTick is the longest the heartbeat go routine waits on its socket
+// before it checks if it has been stopped.
+const HeartbeatTick = 100 * time.Millisecond
+
+//===========================================================================
+// Client Heartbeats
+//===========================================================================
+
+// Heartbeat periodically pings the server from a companion DEALER socket so
+// that a client knows whether the server is alive before it sends a request.
+// The server is considered dead if it has not replied to a heartbeat within
+// liveness intervals. Heartbeats carry the identity of the client so that
+// the server can keep its session alive and mark it dead when they stop.
+type Heartbeat struct {
+	sync.RWMutex
+	transporter *Transporter  // the client the heartbeats are sent for
+	identity    string        // the identity of the client
+	interval    time.Duration // time between heartbeats
+	liveness    int           // missed heartbeats before the server is dead
+	sock        *zmq.Socket   // DEALER socket owned by the heartbeat go routine
+	lastSeen    time.Time     // the time of the last heartbeat reply
+	alive       bool          // if the server was alive when last checked
+	stop        chan struct{} // closed to stop the heartbeat go routine
+	done        chan error    // receives the result of the heartbeat go routine
+}
+
+// Create a heartbeat for the client; the server is presumed alive until it
+// misses liveness heartbeats.
+func newHeartbeat(t *Transporter, interval time.Duration, liveness int) *Heartbeat {
+	if interval <= 0 {
+		interval = DefaultHeartbeatInterval
+	}
+
+	if liveness < 1 {
+		liveness = DefaultHeartbeatLiveness
+	}
+
+	return &Heartbeat{
+		transporter: t,
+		identity:    t.identity,
+		interval:    interval,
+		liveness:    liveness,
+		lastSeen:    time.Now(),
+		alive:       true,
+	}
+}
+
+// Connect the companion socket to the server and start sending heartbeats.
+func (h *Heartbeat) start() (err error) {
+	t := h.transporter
+	if h.sock, err = t.context.NewSocket(zmq.DEALER); err != nil {
+		return WrapError("could not create heartbeat socket", err)
+	}
+
+	// Drop heartbeats rather than queue them while the server is down
+	h.sock.SetLinger(0)
+	h.sock.SetSndhwm(h.liveness)
+	h.sock.SetIdentity(h.identity + "/heartbeat")
+
+	if t.security != nil {
+		if err = t.security.Client(h.sock); err != nil {
+			return err
+		}
+	}
+
+	if err = h.sock.Connect(t.addr); err != nil {
+		return WrapError("could not connect heartbeat socket", err)
+	}
+
+	h.stop = make(chan struct{})
+	h.done = make(chan error, 1)
+	go func() { h.done <- h.run() }()
+
+	debug("sending heartbeats to %s every %s", t.addr, h.interval)
+	return nil
+}
+
+// Close the companion socket and wait for the go routine to exit.
+func (h *Heartbeat) close() error {
+	close(h.stop)
+	return <-h.done
+}
+
+// Alive returns true if the server has replied to a heartbeat within the
+// last liveness intervals.
+func (h *Heartbeat) Alive() bool {
+	h.RLock()
+	defer h.RUnlock()
+	return time.Since(h.lastSeen) < h.interval*time.Duration(h.liveness)
+}
+
+// LastSeen returns the time the server last replied to a heartbeat.
+func (h *Heartbeat) LastSeen() time.Time {
+	h.RLock()
+	defer h.RUnlock()
+	return h.lastSeen
+}
+
+// Send heartbeats every interval and receive replies until stopped.
+func (h *Heartbeat) run() error {
+	defer h.sock.Close()
+
+	poller := zmq.NewPoller()
+	poller.Add(h.sock, zmq.POLLIN)
+
+	next := time.Now()
+	for {
+		select {
+		case <-h.stop:
+			return nil
+		default:
+		}
+
+		if now := time.Now(); !now.Before(next) {
+			h.ping()
+			h.check()
+			next = now.Add(h.interval)
+		}
+
+		wait := time.Until(next)
+		if wait > HeartbeatTick {
+			wait = HeartbeatTick
+		}
+
+		polled, err := poller.Poll(wait)
+		if err != nil {
+			return err
+		}
+
+		if len(polled) > 0 {
+			frames, err := h.sock.RecvMessageBytes(0)
+			if err != nil {
+				warn("could not receive heartbeat: %s", err)
+				continue
+			}
+			h.pong(frames[len(frames)-1])
+		}
+	}
+}
+
+// Send a heartbeat with an empty delimiter like a REQ socket, dropping it if
+// it cannot be queued. The interval and liveness are sent as interval:liveness
+// so the server knows how long to wait before it presumes the client dead.
+func (h *Heartbeat) ping() {
+	data, err := h.transporter.marshal(&pb.BasicMessage{
+		Sender:   h.transporter.name,
+		Message:  fmt.Sprintf("%s:%d", h.interval, h.liveness),
+		Type:     pb.Type_HEARTBEAT,
+		Identity: h.identity,
+	})
+	if err != nil {
+		warn("could not marshal heartbeat: %s", err)
+		return
+	}
+
+	if _, err = h.sock.SendMessageDontwait("", data); err != nil {
+		trace("could not send heartbeat: %s", err)
+	}
+}
+
+// Record a heartbeat reply from the server.
+func (h *Heartbeat) pong(data []byte) {
+	reply := new(pb.BasicMessage)
+	if err := proto.Unmarshal(data, reply); err != nil {
+		warn("could not parse heartbeat: %s", err)
+		return
+	}
+
+	if signer := h.transporter.signer; signer != nil {
+		if err := signer.Verify(reply); err != nil {
+			warn("could not verify heartbeat from %s: %s", reply.Sender, err)
+			return
+		}
+	}
+
+	if reply.Type != pb.Type_HEARTBEAT {
+		debug("unexpected %s reply to heartbeat", reply.Type)
+		return
+	}
+
+	h.Lock()
+	h.lastSeen = time.Now()
+	h.Unlock()
+	h.check()
+}
+
+// Log when the server stops or starts replying to heartbeats.
+func (h *Heartbeat) check() {
+	alive := h.Alive()
+	if alive == h.alive {
+		return
+	}
+
+	h.alive = alive
+	if alive {
+		status("server at %s is responding to heartbeats", h.transporter.addr)
+	} else {
+		warn("server at %s missed %d heartbeats", h.transporter.addr, h.liveness)
+	}
+}
+
+//===========================================================================
+// Server Heartbeats
+//===========================================================================
+
+// Replies to a heartbeat from a client and keeps its session alive.
+func (t *Transporter) heartbeat(message *pb.BasicMessage) {
+	if t.sessions != nil {
+		interval, liveness := parseHeartbeat(message.Message)
+		t.sessions.Heartbeat(message, interval, liveness)
+	}
+
+	reply := &pb.BasicMessage{Sender: t.name, Type: pb.Type_HEARTBEAT, Id: message.Id}
+	if err := t.transmit(reply); err != nil {
+		warn("could not reply to heartbeat: %s", err)
+	}
+}
+
+// Parse the interval and liveness sent with a heartbeat as interval:liveness,
+// using the defaults for any that are missing or invalid.
+func parseHeartbeat(s string) (interval time.Duration, liveness int) {
+	parts := strings.SplitN(s, ":", 2)
+	if d, err := time.ParseDuration(parts[0]); err == nil && d > 0 {
+		interval = d
+	} else {
+		interval = DefaultHeartbeatInterval
+	}
+
+	liveness = DefaultHeartbeatLiveness
+	if len(parts) == 2 {
+		if n, err := strconv.Atoi(parts[1]); err == nil && n > 0 {
+			liveness = n
+		}
+	}
+	return interval, liveness
+}
@@ -0,0 +1,315 @@
+package rtreq
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HistogramPrecision is the number of bits of each value that are kept when
+// it is recorded in a histogram, so values are recorded to within 1 part in
+// 2^(HistogramPrecision-1) (better than 1%).
+const HistogramPrecision = 8
+
+// Percentiles reported by histograms.
+var reportedPercentiles = []float64{50, 90, 99, 99.9}
+
+//===========================================================================
+// High Dynamic Range Histogram
+//===========================================================================
+
+// Histogram records durations in log-linear buckets, in the style of an HDR
+// histogram, so that tail percentiles can be reported over a wide range of
+// values with fixed relative precision and constant memory. Values below
+// 2^HistogramPrecision nanoseconds are recorded exactly; larger values are
+// grouped into buckets whose width doubles with every power of two. Unlike
+// a mean and standard deviation, histograms can be merged across clients
+// and runs without losing the shape of the distribution.
+type Histogram struct {
+	sync.Mutex
+	counts []uint64 // number of values recorded in each bucket
+	total  uint64   // total number of values recorded
+	sum    float64  // sum of all values recorded, to compute the mean
+	min    int64    // smallest value recorded
+	max    int64    // largest value recorded
+}
+
+// NewHistogram creates an empty histogram.
+func NewHistogram() *Histogram {
+	return new(Histogram)
+}
+
+// Record a duration in the histogram; negative durations are recorded as 0.
+func (h *Histogram) Record(d time.Duration) {
+	v := int64(d)
+	if v < 0 {
+		v = 0
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	idx := bucketIndex(v)
+	if idx >= len(h.counts) {
+		counts := make([]uint64, idx+1)
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+
+	h.counts[idx]++
+	if h.total == 0 || v < h.min {
+		h.min = v
+	}
+	if v > h.max {
+		h.max = v
+	}
+	h.total++
+	h.sum += float64(v)
+}
+
+// Merge the values recorded by another histogram into this one.
+func (h *Histogram) Merge(o *Histogram) {
+	if o == nil || o == h {
+		return
+	}
+
+	o.Lock()
+	counts := append([]uint64(nil), o.counts...)
+	total, sum, min, max := o.total, o.sum, o.min, o.max
+	o.Unlock()
+
+	if total == 0 {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	if len(counts) > len(h.counts) {
+		grown := make([]uint64, len(counts))
+		copy(grown, h.counts)
+		h.counts = grown
+	}
+
+	for idx, count := range counts {
+		h.counts[idx] += count
+	}
+
+	if h.total == 0 || min < h.min {
+		h.min = min
+	}
+	if max > h.max {
+		h.max = max
+	}
+	h.total += total
+	h.sum += sum
+}
+
+// Count returns the number of values recorded.
+func (h *Histogram) Count() uint64 {
+	h.Lock()
+	defer h.Unlock()
+	return h.total
+}
+
+// Min returns the smallest value recorded.
+func (h *Histogram) Min() time.Duration {
+	h.Lock()
+	defer h.Unlock()
+	return time.Duration(h.min)
+}
+
+// Max returns the largest value recorded.
+func (h *Histogram) Max() time.Duration {
+	h.Lock()
+	defer h.Unlock()
+	return time.Duration(h.max)
+}
+
+// Mean returns the average of the values recorded.
+func (h *Histogram) Mean() time.Duration {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.total == 0 {
+		return 0
+	}
+	return time.Duration(h.sum / float64(h.total))
+}
+
+// Percentile returns the value below which the percentage (0-100) of values
+// recorded fall, to within the precision of the histogram.
+func (h *Histogram) Percentile(percent float64) time.Duration {
+	h.Lock()
+	defer h.Unlock()
+	return time.Duration(h.percentile(percent))
+}
+
+// Serialize the count, mean, min, max and reported percentiles of the
+// histogram in nanoseconds.
+func (h *Histogram) Serialize() map[string]interface{} {
+	h.Lock()
+	defer h.Unlock()
+
+	data := map[string]interface{}{
+		"count": h.total,
+		"min":   h.min,
+		"max":   h.max,
+		"mean":  0.0,
+	}
+
+	if h.total > 0 {
+		data["mean"] = h.sum / float64(h.total)
+	}
+
+	for _, p := range reportedPercentiles {
+		data[percentileName(p)] = h.percentile(p)
+	}
+	return data
+}
+
+// String returns the reported percentiles and maximum of the histogram.
+func (h *Histogram) String() string {
+	h.Lock()
+	defer h.Unlock()
+
+	s := ""
+	for _, p := range reportedPercentiles {
+		s += fmt.Sprintf("%s=%s ", percentileName(p), time.Duration(h.percentile(p)))
+	}
+	return s + fmt.Sprintf("max=%s", time.Duration(h.max))
+}
+
+// Histograms are serialized with their non-empty buckets so that they can be
+// stored with results and merged later.
+type histogramJSON struct {
+	Precision int               `json:"precision"`
+	Count     uint64            `json:"count"`
+	Sum       float64           `json:"sum"`
+	Min       int64             `json:"min"`
+	Max       int64             `json:"max"`
+	Buckets   map[string]uint64 `json:"buckets"`
+}
+
+// MarshalJSON serializes the non-empty buckets of the histogram.
+func (h *Histogram) MarshalJSON() ([]byte, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	data := histogramJSON{
+		Precision: HistogramPrecision,
+		Count:     h.total,
+		Sum:       h.sum,
+		Min:       h.min,
+		Max:       h.max,
+		Buckets:   make(map[string]uint64),
+	}
+
+	for idx, count := range h.counts {
+		if count > 0 {
+			data.Buckets[strconv.Itoa(idx)] = count
+		}
+	}
+	return json.Marshal(data)
+}
+
+// UnmarshalJSON loads a histogram serialized by MarshalJSON.
+func (h *Histogram) UnmarshalJSON(b []byte) error {
+	var data histogramJSON
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	if data.Precision != HistogramPrecision {
+		return fmt.Errorf("cannot load histogram with precision %d", data.Precision)
+	}
+
+	indices := make([]int, 0, len(data.Buckets))
+	for key := range data.Buckets {
+		idx, err := strconv.Atoi(key)
+		if err != nil || idx < 0 {
+			return fmt.Errorf("invalid histogram bucket '%s'", key)
+		}
+		indices = append(indices, idx)
+	}
+	sort.Ints(indices)
+
+	h.Lock()
+	defer h.Unlock()
+
+	h.counts = nil
+	if n := len(indices); n > 0 {
+		h.counts = make([]uint64, indices[n-1]+1)
+		for _, idx := range indices {
+			h.counts[idx] = data.Buckets[strconv.Itoa(idx)]
+		}
+	}
+
+	h.total, h.sum, h.min, h.max = data.Count, data.Sum, data.Min, data.Max
+	return nil
+}
+
+// Compute the percentile with the lock held using the nearest rank, i.e. the
+// smallest value that at least the percentage of values are less than or
+// equal to. The highest value of the bucket the percentile falls in is
+// returned, but never more than the maximum.
+func (h *Histogram) percentile(percent float64) int64 {
+	if h.total == 0 {
+		return 0
+	}
+
+	rank := uint64(math.Ceil(percent * float64(h.total) / 100))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > h.total {
+		rank = h.total
+	}
+
+	var seen uint64
+	for idx, count := range h.counts {
+		seen += count
+		if seen >= rank {
+			if v := bucketMax(idx); v < h.max {
+				return v
+			}
+			return h.max
+		}
+	}
+	return h.max
+}
+
+// Returns the index of the bucket the value is recorded in. Values less than
+// 2^p are their own bucket; larger values keep their p most significant bits.
+func bucketIndex(v int64) int {
+	const half = 1 << (HistogramPrecision - 1)
+	msb := bits.Len64(uint64(v)) - 1
+	if msb < HistogramPrecision {
+		return int(v)
+	}
+
+	shift := uint(msb - HistogramPrecision + 1)
+	return int(shift)*half + int(v>>shift)
+}
+
+// Returns the largest value that is recorded in the bucket.
+func bucketMax(idx int) int64 {
+	const half = 1 << (HistogramPrecision - 1)
+	if idx < 2*half {
+		return int64(idx)
+	}
+
+	shift := uint(idx/half - 1)
+	sub := int64(idx - int(shift)*half)
+	return (sub+1)<<shift - 1
+}
+
+// Returns the name of a percentile in results, e.g. p99.9.
+func percentileName(p float64) string {
+	return "p" + strconv.FormatFloat(p, 'f', -1, 64)
+}
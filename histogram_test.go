@@ -0,0 +1,146 @@
+package rtreq
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestBucketRoundTrip(t *testing.T) {
+	values := []int64{0, 1, 127, 128, 255, 256, 257, 1000, 1023, 1024, 123456789, int64(time.Hour)}
+	for _, v := range values {
+		idx := bucketIndex(v)
+		max := bucketMax(idx)
+		if max < v {
+			t.Errorf("bucket %d of %d has max %d less than the value", idx, v, max)
+		}
+
+		if bucketIndex(max) != idx {
+			t.Errorf("max %d of bucket %d is recorded in bucket %d", max, idx, bucketIndex(max))
+		}
+
+		// Values must be recorded to within the precision of the histogram
+		if err := float64(max-v) / float64(v+1); err > 1/float64(int64(1)<<(HistogramPrecision-1)) {
+			t.Errorf("bucket %d of %d has max %d with error %0.4f", idx, v, max, err)
+		}
+	}
+
+	// Adjacent buckets must not overlap or leave gaps
+	for idx := 1; idx < 4096; idx++ {
+		if bucketIndex(bucketMax(idx-1)+1) != idx {
+			t.Fatalf("value %d after bucket %d is not recorded in bucket %d", bucketMax(idx-1)+1, idx-1, idx)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	tests := []struct {
+		values  []int64
+		percent float64
+		expect  time.Duration
+	}{
+		{nil, 50, 0},
+		{[]int64{1, 2, 3}, 50, 2},
+		{[]int64{1, 2, 3}, 0, 1},
+		{[]int64{1, 2, 3}, 66, 2},
+		{[]int64{1, 2, 3}, 67, 3},
+		{[]int64{1, 2, 3}, 100, 3},
+		{[]int64{1, 2, 3, 4}, 50, 2},
+		{[]int64{1, 2, 3, 4}, 75, 3},
+		{[]int64{5}, 99.9, 5},
+	}
+
+	for _, tc := range tests {
+		h := NewHistogram()
+		for _, v := range tc.values {
+			h.Record(time.Duration(v))
+		}
+
+		if p := h.Percentile(tc.percent); p != tc.expect {
+			t.Errorf("%s of %v is %d, expected %d", percentileName(tc.percent), tc.values, p, tc.expect)
+		}
+	}
+
+	h := NewHistogram()
+	for v := 1; v <= 100; v++ {
+		h.Record(time.Duration(v))
+	}
+
+	for _, p := range []float64{1, 50, 90, 99, 100} {
+		if v := h.Percentile(p); v != time.Duration(p) {
+			t.Errorf("%s of 1 to 100 is %d, expected %0.0f", percentileName(p), v, p)
+		}
+	}
+}
+
+func TestHistogramMerge(t *testing.T) {
+	a, b, all := NewHistogram(), NewHistogram(), NewHistogram()
+	for v := int64(1); v <= 1000; v++ {
+		d := time.Duration(v * v)
+		if v%3 == 0 {
+			a.Record(d)
+		} else {
+			b.Record(d)
+		}
+		all.Record(d)
+	}
+
+	a.Merge(b)
+	if a.Count() != all.Count() || a.Min() != all.Min() || a.Max() != all.Max() || a.Mean() != all.Mean() {
+		t.Errorf("merged histogram %s does not match %s", a, all)
+	}
+
+	for _, p := range []float64{0, 1, 50, 90, 99, 99.9, 100} {
+		if a.Percentile(p) != all.Percentile(p) {
+			t.Errorf("merged %s is %d, expected %d", percentileName(p), a.Percentile(p), all.Percentile(p))
+		}
+	}
+
+	// Merging nothing, the histogram itself or an empty histogram is a no-op
+	a.Merge(nil)
+	a.Merge(a)
+	a.Merge(NewHistogram())
+	if a.Count() != all.Count() || a.Min() != all.Min() || a.Max() != all.Max() {
+		t.Errorf("no-op merges changed histogram to %s", a)
+	}
+
+	// Merging into an empty histogram copies the minimum
+	empty := NewHistogram()
+	empty.Merge(all)
+	if empty.Min() != all.Min() || empty.Count() != all.Count() {
+		t.Errorf("merge into empty histogram is %s, expected %s", empty, all)
+	}
+}
+
+func TestHistogramJSON(t *testing.T) {
+	h := NewHistogram()
+	for _, v := range []int64{0, 3, 200, 4096, 123456789, int64(time.Second)} {
+		h.Record(time.Duration(v))
+	}
+
+	data, err := json.Marshal(h)
+	if err != nil {
+		t.Fatalf("could not marshal histogram: %s", err)
+	}
+
+	loaded := NewHistogram()
+	if err := json.Unmarshal(data, loaded); err != nil {
+		t.Fatalf("could not unmarshal histogram: %s", err)
+	}
+
+	if loaded.Count() != h.Count() || loaded.Min() != h.Min() || loaded.Max() != h.Max() || loaded.Mean() != h.Mean() {
+		t.Errorf("loaded histogram %s does not match %s", loaded, h)
+	}
+
+	for _, p := range []float64{0, 50, 90, 99, 99.9, 100} {
+		if loaded.Percentile(p) != h.Percentile(p) {
+			t.Errorf("loaded %s is %d, expected %d", percentileName(p), loaded.Percentile(p), h.Percentile(p))
+		}
+	}
+
+	// Histograms recorded with a different precision cannot be loaded
+	bad := []byte(`{"precision": 4, "count": 1, "buckets": {"1": 1}}`)
+	if err := json.Unmarshal(bad, NewHistogram()); err == nil {
+		t.Error("expected histogram with a different precision to be rejected")
+	}
+}
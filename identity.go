@@ -0,0 +1,151 @@
+package rtreq
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DuplicateWindow is how long the server remembers a connection that has
+// been superseded by a new connection with the same identity. A client that
+// resets its socket never sends on the old connection again, so a message on
+// a superseded connection within the window means both are live.
+const DuplicateWindow = time.Minute
+
+//===========================================================================
+// Client Identities
+//===========================================================================
+
+// Create an identity for a client with the specified name, using a random
+// (version 4) UUID so that identities do not collide even when many clients
+// with the same name are started in parallel with the same seed.
+func newIdentity(name string) string {
+	var uuid [16]byte
+	randomBytes(uuid[:])
+
+	uuid[6] = (uuid[6] & 0x0f) | 0x40 // version 4
+	uuid[8] = (uuid[8] & 0x3f) | 0x80 // RFC 4122 variant
+
+	return fmt.Sprintf("%s-%x-%x-%x-%x-%x", name, uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:])
+}
+
+// Returns the name of the client that created the identity by removing the
+// UUID suffix; identities that were not created by clients are returned as is.
+func identityName(identity string) string {
+	parts := strings.Split(identity, "-")
+	if len(parts) < 6 {
+		return identity
+	}
+	return strings.Join(parts[:len(parts)-5], "-")
+}
+
+// Create a random id for a new connection of a client.
+func newConnectionID() uint64 {
+	var id [8]byte
+	randomBytes(id[:])
+	return binary.BigEndian.Uint64(id[:])
+}
+
+// Fill the buffer from the cryptographic random source, falling back on the
+// seeded random source if it is unavailable.
+func randomBytes(buf []byte) {
+	if _, err := crand.Read(buf); err != nil {
+		warn("could not read random bytes: %s", err)
+		for i := range buf {
+			buf[i] = byte(rand.Intn(256))
+		}
+	}
+}
+
+//===========================================================================
+// Duplicate Identity Detection
+//===========================================================================
+
+// IdentityTracker detects when two live connections present the same client
+// identity. Every connection of a client sends a random connection id with
+// its requests; when a new connection id is seen for an identity, the old
+// connection is superseded. If a superseded connection is seen again, two
+// connections with the same identity are live. Identities that have not been
+// seen within the DuplicateWindow are forgotten. Trackers are safe to share
+// between the workers of a server.
+type IdentityTracker struct {
+	sync.Mutex
+	identities map[string]*connections // connections seen per identity
+	swept      time.Time               // the last time idle identities were forgotten
+}
+
+// Connections that have presented the same identity.
+type connections struct {
+	seen       time.Time            // the last time the identity was seen
+	current    uint64               // the most recent connection
+	superseded map[uint64]time.Time // previous connections and when they were replaced
+	duplicate  bool                 // if a duplicate has already been reported
+}
+
+// NewIdentityTracker creates an empty identity tracker.
+func NewIdentityTracker() *IdentityTracker {
+	return &IdentityTracker{identities: make(map[string]*connections), swept: time.Now()}
+}
+
+// Observe a request from the connection of the client identity, returning
+// true if another connection with the same identity is also live.
+func (t *IdentityTracker) Observe(identity string, connection uint64) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now()
+	t.expire(now)
+
+	conns, ok := t.identities[identity]
+	if !ok {
+		t.identities[identity] = &connections{
+			seen:       now,
+			current:    connection,
+			superseded: make(map[uint64]time.Time),
+		}
+		return false
+	}
+
+	conns.seen = now
+	if conns.current == connection {
+		return false
+	}
+
+	// Forget connections that were superseded outside of the window
+	for conn, replaced := range conns.superseded {
+		if now.Sub(replaced) > DuplicateWindow {
+			delete(conns.superseded, conn)
+		}
+	}
+
+	_, duplicate := conns.superseded[connection]
+	conns.superseded[conns.current] = now
+	delete(conns.superseded, connection)
+	conns.current = connection
+
+	if duplicate && !conns.duplicate {
+		conns.duplicate = true
+		warn("multiple live connections are using client identity %s", identity)
+	}
+	return duplicate
+}
+
+// Forget identities that have not been seen within the window, at most once
+// per window, since their superseded connections have also expired. Must be
+// called with the lock held.
+func (t *IdentityTracker) expire(now time.Time) {
+	if now.Sub(t.swept) < DuplicateWindow {
+		return
+	}
+
+	for identity, conns := range t.identities {
+		if now.Sub(conns.seen) > DuplicateWindow {
+			delete(t.identities, identity)
+		}
+	}
+	t.swept = now
+}
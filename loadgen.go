@@ -0,0 +1,277 @@
+package rtreq
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bbengfort/x/stats"
+)
+
+// ScheduleTolerance is how late a request may be sent after its intended
+// send time before it is counted as having missed its schedule.
+const ScheduleTolerance = time.Millisecond
+
+//===========================================================================
+// Arrival Processes
+//===========================================================================
+
+// Arrival is the process that determines the intended send times of the
+// requests of an open-loop load generator.
+type Arrival uint8
+
+// Arrival processes: constant arrivals are evenly spaced at the target rate,
+// Poisson arrivals have exponentially distributed gaps with the same mean.
+const (
+	ConstantArrivals Arrival = iota
+	PoissonArrivals
+)
+
+var arrivalStrings = [...]string{"constant", "poisson"}
+
+// String returns a human readable representation of the arrival process.
+func (a Arrival) String() string {
+	return arrivalStrings[a]
+}
+
+// ParseArrival parses the name of an arrival process, constant or poisson.
+func ParseArrival(s string) (Arrival, error) {
+	for i, name := range arrivalStrings {
+		if strings.EqualFold(s, name) {
+			return Arrival(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown arrival process '%s'", s)
+}
+
+// Returns the time between two requests at the rate in requests per second.
+func (a Arrival) gap(rate float64) time.Duration {
+	mean := float64(time.Second) / rate
+	if a == PoissonArrivals {
+		return time.Duration(rand.ExpFloat64() * mean)
+	}
+	return time.Duration(mean)
+}
+
+//===========================================================================
+// Open-Loop Load Generator
+//===========================================================================
+
+// LoadGenerator issues requests to the server at a target rate regardless of
+// how quickly the server replies, using an asynchronous client so that slow
+// replies do not delay the next request. Latency is measured from the time
+// each request was intended to be sent rather than when it was actually
+// sent, so that delays in the generator itself are not hidden (coordinated
+// omission). Requests sent later than their intended time are counted as
+// having missed their schedule.
+type LoadGenerator struct {
+	sync.Mutex
+	client    *AsyncClient      // client the requests are sent from
+	rate      float64           // target requests per second
+	arrival   Arrival           // process that spaces the requests
+	phases    Phases            // warmup and cooldown of the most recent run
+	sampler   *Sampler          // time series of the most recent run, if sampled
+	requests  *requestStream    // requests sent by the generator, default if nil
+	elapsed   time.Duration     // measured duration of the most recent run
+	wall      time.Duration     // duration including waiting for replies
+	scheduled uint64            // number of requests issued
+	completed uint64            // number of successful replies
+	failed    uint64            // number of requests that failed
+	timeouts  uint64            // number of requests that timed out
+	missed    uint64            // number of requests sent behind schedule
+	maxLag    time.Duration     // latest a request was sent behind schedule
+	latency   *stats.Statistics // time from intended send to reply
+	service   *stats.Statistics // time from actual send to reply
+	latencyH  *Histogram        // histogram of time from intended send to reply
+	serviceH  *Histogram        // histogram of time from actual send to reply
+}
+
+// NewLoadGenerator creates an open-loop load generator that sends requests
+// from the connected client at rate requests per second.
+func NewLoadGenerator(client *AsyncClient, rate float64, arrival Arrival) (*LoadGenerator, error) {
+	if rate <= 0 {
+		return nil, fmt.Errorf("rate must be positive, not %0.3f", rate)
+	}
+
+	g := &LoadGenerator{client: client, rate: rate, arrival: arrival}
+	g.reset()
+	return g, nil
+}
+
+// SetWorkload specifies the mix of requests the generator sends; if nil,
+// small numbered messages are sent.
+func (g *LoadGenerator) SetWorkload(workload *Workload) {
+	g.requests = workload.stream(0)
+}
+
+// Run the load generator for the duration, then wait for the replies to all
+// of the outstanding requests, which time out after timeout. Only requests
+// intended to be sent during the duration, after the warmup and before the
+// cooldown, are recorded. If a sampler is specified, the requests are also
+// sampled every interval throughout the run.
+func (g *LoadGenerator) Run(duration time.Duration, phases Phases, timeout time.Duration, sampler *Sampler) error {
+	g.reset()
+	g.phases = phases
+	g.sampler = sampler
+	g.requests.reset()
+
+	var wg sync.WaitGroup
+	status("starting open-loop benchmark at %0.1f msg/sec with %s arrivals for %s", g.rate, g.arrival, duration)
+
+	start := time.Now()
+	measure := phases.window(duration)
+	sampler.start()
+	sampler.Join()
+	intended := start
+	for intended.Before(start.Add(phases.Total(duration))) {
+		// Wait until the intended send time of the next request
+		if wait := time.Until(intended); wait > 0 {
+			time.Sleep(wait)
+		}
+
+		// Send requests outside of the measurement window without recording
+		if !measure.contains(intended) {
+			_, message := g.requests.next(0)
+			sample := sampleRequest(sampler, intended)
+			wg.Add(1)
+			g.client.Request(message, timeout, func(f *Future) {
+				defer wg.Done()
+				sample(f)
+			})
+			intended = intended.Add(g.arrival.gap(g.rate))
+			continue
+		}
+
+		// Count the request if the generator has fallen behind
+		if lag := time.Since(intended); lag > ScheduleTolerance {
+			g.Lock()
+			g.missed++
+			if lag > g.maxLag {
+				g.maxLag = lag
+			}
+			g.Unlock()
+		}
+
+		wg.Add(1)
+		g.issue(intended, timeout, sampler, wg.Done)
+		intended = intended.Add(g.arrival.gap(g.rate))
+	}
+
+	g.elapsed = measure.elapsed()
+	sampler.Leave()
+	wg.Wait()
+	g.wall = time.Since(start)
+	sampler.close()
+	return nil
+}
+
+// Returns a callback that samples a request intended to be sent at the time
+// without recording it in the results. The sampler is bound when the
+// callback is created, since the request may be resolved after the run.
+func sampleRequest(sampler *Sampler, intended time.Time) func(*Future) {
+	return func(f *Future) {
+		if f.Err() != nil {
+			sampler.Fail()
+			return
+		}
+		sampler.Record(time.Since(intended))
+	}
+}
+
+// Send a request intended to be sent at the time, recording its latency
+// from that time when it is resolved.
+func (g *LoadGenerator) issue(intended time.Time, timeout time.Duration, sampler *Sampler, done func()) {
+	g.Lock()
+	g.scheduled++
+	class, message := g.requests.next(g.scheduled)
+	g.Unlock()
+
+	sample := sampleRequest(sampler, intended)
+	g.client.Request(message, timeout, func(f *Future) {
+		defer done()
+		sample(f)
+
+		g.Lock()
+		defer g.Unlock()
+
+		switch err := f.Err(); {
+		case err == nil:
+			g.completed++
+			latency := time.Since(intended)
+			g.latency.Update(float64(latency))
+			g.service.Update(float64(f.Latency()))
+			g.latencyH.Record(latency)
+			g.requests.record(class, len(message), latency)
+			g.serviceH.Record(f.Latency())
+		case err == ErrRequestTimeout:
+			g.timeouts++
+		default:
+			g.failed++
+			debug("open-loop request failed: %s", err)
+		}
+	})
+}
+
+// Results appends the results of the most recent run to the path.
+func (g *LoadGenerator) Results(path string, data map[string]interface{}) error {
+	g.Lock()
+	defer g.Unlock()
+
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+
+	achieved, concurrency := wallClock(g.completed, time.Duration(g.service.Total()), g.elapsed)
+	data["mode"] = "open-loop"
+	data["name"] = g.client.identity
+	data["arrivals"] = g.arrival.String()
+	data["target rate (msg/sec)"] = g.rate
+	data["achieved rate (msg/sec)"] = achieved
+	data["duration (nsec)"] = g.elapsed.Nanoseconds()
+	g.phases.Serialize(data)
+	data["wall-clock duration (nsec)"] = g.wall.Nanoseconds()
+	data["achieved concurrency"] = concurrency
+	data["scheduled"] = g.scheduled
+	data["messages"] = g.completed
+	data["failed"] = g.failed
+	data["timeouts"] = g.timeouts
+	data["missed schedule"] = g.missed
+	data["max schedule lag (nsec)"] = g.maxLag.Nanoseconds()
+	data["latency distribution"] = g.latency.Serialize()
+	data["service time distribution"] = g.service.Serialize()
+	data["latency percentiles"] = g.latencyH.Serialize()
+	data["service time percentiles"] = g.serviceH.Serialize()
+	data["latency histogram"] = g.latencyH
+	if g.sampler != nil {
+		data["time series"] = g.sampler.Serialize()
+	}
+	g.requests.serialize(data)
+
+	debug("writing results to %s", path)
+	status(
+		"%d of %d messages at %0.3f msg/sec (target %0.3f) with %0.2f concurrent requests - %d timeouts, %d failed, %d behind schedule - %s",
+		g.completed, g.scheduled, achieved, g.rate, concurrency, g.timeouts, g.failed, g.missed, g.latencyH,
+	)
+	return appendJSON(path, data)
+}
+
+// Reset the results of the load generator.
+func (g *LoadGenerator) reset() {
+	g.Lock()
+	defer g.Unlock()
+
+	g.elapsed = 0
+	g.wall = 0
+	g.scheduled = 0
+	g.completed = 0
+	g.failed = 0
+	g.timeouts = 0
+	g.missed = 0
+	g.maxLag = 0
+	g.latency = new(stats.Statistics)
+	g.service = new(stats.Statistics)
+	g.latencyH = NewHistogram()
+	g.serviceH = NewHistogram()
+}
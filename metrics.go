@@ -17,14 +17,22 @@ import (
 // statistics perform online computations of the distribution of values.
 type Metrics struct {
 	sync.RWMutex
-	started  time.Time         // The time of the first client message
-	finished time.Time         // The time of the last client message
-	accesses map[string]uint64 // The number of messages per-client recv by the server
+	started     time.Time         // The time of the first client message
+	finished    time.Time         // The time of the last client message
+	accesses    map[string]uint64 // The number of messages per-client recv by the server
+	rejections  uint64            // The number of connections rejected by authentication
+	throttles   uint64            // The number of messages dropped by rate limits
+	expirations uint64            // The number of requests dropped after their deadline
+	duplicates  uint64            // The number of messages from duplicate client identities
+	topics      map[string]bool   // The topics that currently have subscribers
+	subscribes  uint64            // The number of topic subscriptions forwarded
+	published   uint64            // The number of messages published to subscribers
 }
 
 // Init the metrics
 func (m *Metrics) Init() {
 	m.accesses = make(map[string]uint64)
+	m.topics = make(map[string]bool)
 }
 
 // Accesses returns the total number of accesses to the replica.
@@ -59,6 +67,115 @@ func (m *Metrics) Complete() {
 	m.finished = time.Now()
 }
 
+// Reject counts a connection that failed authentication.
+func (m *Metrics) Reject() {
+	m.Lock()
+	defer m.Unlock()
+
+	m.rejections++
+}
+
+// Rejections returns the number of connections rejected by authentication.
+func (m *Metrics) Rejections() uint64 {
+	m.RLock()
+	defer m.RUnlock()
+	return m.rejections
+}
+
+// Throttle counts a message that was dropped because the client exceeded
+// its rate limit.
+func (m *Metrics) Throttle() {
+	m.Lock()
+	defer m.Unlock()
+
+	m.throttles++
+}
+
+// Throttles returns the number of messages dropped by rate limits.
+func (m *Metrics) Throttles() uint64 {
+	m.RLock()
+	defer m.RUnlock()
+	return m.throttles
+}
+
+// Expire counts a request that was dropped because its deadline passed
+// before it could be handled.
+func (m *Metrics) Expire() {
+	m.Lock()
+	defer m.Unlock()
+
+	m.expirations++
+}
+
+// Expirations returns the number of requests dropped after their deadline.
+func (m *Metrics) Expirations() uint64 {
+	m.RLock()
+	defer m.RUnlock()
+	return m.expirations
+}
+
+// Duplicate counts a message received from a client identity that is used
+// by more than one live connection.
+func (m *Metrics) Duplicate() {
+	m.Lock()
+	defer m.Unlock()
+
+	m.duplicates++
+}
+
+// Duplicates returns the number of messages from duplicate client identities.
+func (m *Metrics) Duplicates() uint64 {
+	m.RLock()
+	defer m.RUnlock()
+	return m.duplicates
+}
+
+// Subscribe counts a subscription to the topic.
+func (m *Metrics) Subscribe(topic string) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.subscribes++
+	m.topics[topic] = true
+}
+
+// Unsubscribe records that the topic no longer has any subscribers.
+func (m *Metrics) Unsubscribe(topic string) {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.topics, topic)
+}
+
+// Subscriptions returns the number of topic subscriptions.
+func (m *Metrics) Subscriptions() uint64 {
+	m.RLock()
+	defer m.RUnlock()
+	return m.subscribes
+}
+
+// Topics returns the number of topics that currently have subscribers.
+func (m *Metrics) Topics() int {
+	m.RLock()
+	defer m.RUnlock()
+	return len(m.topics)
+}
+
+// Publish counts a message forwarded from a publisher to subscribers.
+func (m *Metrics) Publish() {
+	m.Lock()
+	defer m.Unlock()
+
+	m.published++
+}
+
+// Publications returns the number of messages published to subscribers.
+func (m *Metrics) Publications() uint64 {
+	m.RLock()
+	defer m.RUnlock()
+	return m.published
+}
+
 // Duration computes the amount of time during which accesses were received.
 func (m *Metrics) Duration() time.Duration {
 	m.RLock()
@@ -124,6 +241,13 @@ func (m *Metrics) Serialize(extra map[string]interface{}) map[string]interface{}
 	data["mean"] = m.ClientMean()
 	data["duration"] = m.Duration().String()
 	data["throughput"] = m.Throughput()
+	data["rejections"] = m.Rejections()
+	data["throttles"] = m.Throttles()
+	data["expirations"] = m.Expirations()
+	data["duplicates"] = m.Duplicates()
+	data["subscriptions"] = m.Subscriptions()
+	data["topics"] = m.Topics()
+	data["publications"] = m.Publications()
 
 	for key, val := range extra {
 		data[key] = val
@@ -137,10 +261,34 @@ func (m *Metrics) String() string {
 	m.RLock()
 	defer m.RUnlock()
 
-	return fmt.Sprintf(
+	msg := fmt.Sprintf(
 		"%d accesses by %d clients in %s -- %0.4f accesses/second",
 		m.Accesses(), m.NClients(), m.Duration(), m.Throughput(),
 	)
+
+	if m.rejections > 0 {
+		msg += fmt.Sprintf(" (%d connections rejected)", m.rejections)
+	}
+
+	if m.throttles > 0 {
+		msg += fmt.Sprintf(" (%d messages rate limited)", m.throttles)
+	}
+
+	if m.expirations > 0 {
+		msg += fmt.Sprintf(" (%d requests expired)", m.expirations)
+	}
+
+	if m.duplicates > 0 {
+		msg += fmt.Sprintf(" (%d messages from duplicate identities)", m.duplicates)
+	}
+
+	if m.subscribes > 0 || m.published > 0 {
+		msg += fmt.Sprintf(
+			" (%d messages published, %d subscriptions to %d topics)",
+			m.published, m.subscribes, len(m.topics),
+		)
+	}
+	return msg
 }
 
 // Append another metrics' data to the current metrics
@@ -154,6 +302,15 @@ func (m *Metrics) Append(o *Metrics) {
 	for client, count := range o.accesses {
 		m.accesses[client] += count
 	}
+	m.rejections += o.rejections
+	m.throttles += o.throttles
+	m.expirations += o.expirations
+	m.duplicates += o.duplicates
+	m.subscribes += o.subscribes
+	m.published += o.published
+	for topic := range o.topics {
+		m.topics[topic] = true
+	}
 
 	// If the other started time is earlier, set it as started
 	if !o.started.IsZero() && (m.started.IsZero() || o.started.Before(m.started)) {
@@ -27,9 +27,90 @@ var _ = math.Inf
 // proto package needs to be updated.
 const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
 
+type Type int32
+
+const (
+	Type_MESSAGE      Type = 0
+	Type_REJECTED     Type = 1
+	Type_RATE_LIMITED Type = 2
+	Type_EXPIRED      Type = 3
+	Type_SESSIONS     Type = 4
+	Type_HEARTBEAT    Type = 5
+	Type_SUBSCRIBE    Type = 6
+	Type_UNSUBSCRIBE  Type = 7
+	Type_NOTIFICATION Type = 8
+)
+
+var Type_name = map[int32]string{
+	0: "MESSAGE",
+	1: "REJECTED",
+	2: "RATE_LIMITED",
+	3: "EXPIRED",
+	4: "SESSIONS",
+	5: "HEARTBEAT",
+	6: "SUBSCRIBE",
+	7: "UNSUBSCRIBE",
+	8: "NOTIFICATION",
+}
+var Type_value = map[string]int32{
+	"MESSAGE":      0,
+	"REJECTED":     1,
+	"RATE_LIMITED": 2,
+	"EXPIRED":      3,
+	"SESSIONS":     4,
+	"HEARTBEAT":    5,
+	"SUBSCRIBE":    6,
+	"UNSUBSCRIBE":  7,
+	"NOTIFICATION": 8,
+}
+
+func (x Type) String() string {
+	return proto.EnumName(Type_name, int32(x))
+}
+func (Type) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{0} }
+
+type Status int32
+
+const (
+	Status_OK                Status = 0
+	Status_INVALID_ARGUMENT  Status = 1
+	Status_UNAVAILABLE       Status = 2
+	Status_DEADLINE_EXCEEDED Status = 3
+	Status_INTERNAL          Status = 4
+)
+
+var Status_name = map[int32]string{
+	0: "OK",
+	1: "INVALID_ARGUMENT",
+	2: "UNAVAILABLE",
+	3: "DEADLINE_EXCEEDED",
+	4: "INTERNAL",
+}
+var Status_value = map[string]int32{
+	"OK":                0,
+	"INVALID_ARGUMENT":  1,
+	"UNAVAILABLE":       2,
+	"DEADLINE_EXCEEDED": 3,
+	"INTERNAL":          4,
+}
+
+func (x Status) String() string {
+	return proto.EnumName(Status_name, int32(x))
+}
+func (Status) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{1} }
+
 type BasicMessage struct {
-	Sender  string `protobuf:"bytes,1,opt,name=sender" json:"sender,omitempty"`
-	Message string `protobuf:"bytes,2,opt,name=message" json:"message,omitempty"`
+	Sender     string `protobuf:"bytes,1,opt,name=sender" json:"sender,omitempty"`
+	Message    string `protobuf:"bytes,2,opt,name=message" json:"message,omitempty"`
+	Timestamp  int64  `protobuf:"varint,3,opt,name=timestamp" json:"timestamp,omitempty"`
+	Signature  []byte `protobuf:"bytes,4,opt,name=signature,proto3" json:"signature,omitempty"`
+	Type       Type   `protobuf:"varint,5,opt,name=type,enum=msg.Type" json:"type,omitempty"`
+	Deadline   int64  `protobuf:"varint,6,opt,name=deadline" json:"deadline,omitempty"`
+	Status     Status `protobuf:"varint,7,opt,name=status,enum=msg.Status" json:"status,omitempty"`
+	Error      string `protobuf:"bytes,8,opt,name=error" json:"error,omitempty"`
+	Id         uint64 `protobuf:"varint,9,opt,name=id" json:"id,omitempty"`
+	Identity   string `protobuf:"bytes,10,opt,name=identity" json:"identity,omitempty"`
+	Connection uint64 `protobuf:"varint,11,opt,name=connection" json:"connection,omitempty"`
 }
 
 func (m *BasicMessage) Reset()                    { *m = BasicMessage{} }
@@ -51,18 +132,104 @@ func (m *BasicMessage) GetMessage() string {
 	return ""
 }
 
+func (m *BasicMessage) GetTimestamp() int64 {
+	if m != nil {
+		return m.Timestamp
+	}
+	return 0
+}
+
+func (m *BasicMessage) GetSignature() []byte {
+	if m != nil {
+		return m.Signature
+	}
+	return nil
+}
+
+func (m *BasicMessage) GetType() Type {
+	if m != nil {
+		return m.Type
+	}
+	return Type_MESSAGE
+}
+
+func (m *BasicMessage) GetDeadline() int64 {
+	if m != nil {
+		return m.Deadline
+	}
+	return 0
+}
+
+func (m *BasicMessage) GetStatus() Status {
+	if m != nil {
+		return m.Status
+	}
+	return Status_OK
+}
+
+func (m *BasicMessage) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
+
+func (m *BasicMessage) GetId() uint64 {
+	if m != nil {
+		return m.Id
+	}
+	return 0
+}
+
+func (m *BasicMessage) GetIdentity() string {
+	if m != nil {
+		return m.Identity
+	}
+	return ""
+}
+
+func (m *BasicMessage) GetConnection() uint64 {
+	if m != nil {
+		return m.Connection
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*BasicMessage)(nil), "msg.BasicMessage")
+	proto.RegisterEnum("msg.Type", Type_name, Type_value)
+	proto.RegisterEnum("msg.Status", Status_name, Status_value)
 }
 
 func init() { proto.RegisterFile("message.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 91 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0xcd, 0x4d, 0x2d, 0x2e,
-	0x4e, 0x4c, 0x4f, 0xd5, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0xce, 0x2d, 0x4e, 0x57, 0x72,
-	0xe0, 0xe2, 0x71, 0x4a, 0x2c, 0xce, 0x4c, 0xf6, 0x85, 0x48, 0x09, 0x89, 0x71, 0xb1, 0x15, 0xa7,
-	0xe6, 0xa5, 0xa4, 0x16, 0x49, 0x30, 0x2a, 0x30, 0x6a, 0x70, 0x06, 0x41, 0x79, 0x42, 0x12, 0x5c,
-	0xec, 0x50, 0xdd, 0x12, 0x4c, 0x60, 0x09, 0x18, 0x37, 0x89, 0x0d, 0x6c, 0x9a, 0x31, 0x20, 0x00,
-	0x00, 0xff, 0xff, 0xf8, 0xac, 0x16, 0xde, 0x5e, 0x00, 0x00, 0x00,
+	// 425 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x4c, 0x92, 0xd1, 0x8e, 0x93, 0x40,
+	0x14, 0x86, 0x17, 0xca, 0xd2, 0x72, 0xda, 0x5d, 0xc7, 0xc9, 0x6a, 0x26, 0x46, 0x0d, 0xd1, 0x1b,
+	0xb2, 0x17, 0xbd, 0xd0, 0x27, 0x18, 0xca, 0x71, 0x1d, 0xa5, 0xd4, 0x0c, 0x74, 0xb3, 0x17, 0x26,
+	0x0d, 0x96, 0x49, 0x43, 0x22, 0xd0, 0x30, 0xb3, 0x17, 0x7d, 0x0a, 0xdf, 0xc8, 0x67, 0x33, 0x4c,
+	0xbb, 0x5b, 0x2f, 0xbf, 0xef, 0x3f, 0xff, 0xe1, 0x84, 0x0c, 0x5c, 0x35, 0x4a, 0xeb, 0x72, 0xa7,
+	0xe6, 0xfb, 0xbe, 0x33, 0x1d, 0x1d, 0x35, 0x7a, 0xf7, 0xe1, 0xaf, 0x0b, 0xb3, 0xb8, 0xd4, 0xf5,
+	0x76, 0x79, 0xcc, 0xe8, 0x6b, 0xf0, 0xb5, 0x6a, 0x2b, 0xd5, 0x33, 0x27, 0x74, 0xa2, 0x40, 0x9e,
+	0x88, 0x32, 0x18, 0x9f, 0xea, 0xcc, 0xb5, 0xc1, 0x13, 0xd2, 0xb7, 0x10, 0x98, 0xba, 0x51, 0xda,
+	0x94, 0xcd, 0x9e, 0x8d, 0x42, 0x27, 0x1a, 0xc9, 0xb3, 0x18, 0x52, 0x5d, 0xef, 0xda, 0xd2, 0x3c,
+	0xf6, 0x8a, 0x79, 0xa1, 0x13, 0xcd, 0xe4, 0x59, 0xd0, 0x77, 0xe0, 0x99, 0xc3, 0x5e, 0xb1, 0xcb,
+	0xd0, 0x89, 0xae, 0x3f, 0x05, 0xf3, 0x46, 0xef, 0xe6, 0xc5, 0x61, 0xaf, 0xa4, 0xd5, 0xf4, 0x0d,
+	0x4c, 0x2a, 0x55, 0x56, 0xbf, 0xeb, 0x56, 0x31, 0xdf, 0x6e, 0x7e, 0x66, 0xfa, 0x11, 0x7c, 0x6d,
+	0x4a, 0xf3, 0xa8, 0xd9, 0xd8, 0x96, 0xa7, 0xb6, 0x9c, 0x5b, 0x25, 0x4f, 0x11, 0xbd, 0x81, 0x4b,
+	0xd5, 0xf7, 0x5d, 0xcf, 0x26, 0xf6, 0xe6, 0x23, 0xd0, 0x6b, 0x70, 0xeb, 0x8a, 0x05, 0xa1, 0x13,
+	0x79, 0xd2, 0xad, 0xab, 0xe1, 0x33, 0x75, 0xa5, 0x5a, 0x53, 0x9b, 0x03, 0x03, 0x3b, 0xf8, 0xcc,
+	0xf4, 0x3d, 0xc0, 0xb6, 0x6b, 0x5b, 0xb5, 0x35, 0x75, 0xd7, 0xb2, 0xa9, 0xed, 0xfc, 0x67, 0x6e,
+	0xff, 0x38, 0xe0, 0x0d, 0x17, 0xd3, 0x29, 0x8c, 0x97, 0x98, 0xe7, 0xfc, 0x0e, 0xc9, 0x05, 0x9d,
+	0xc1, 0x44, 0xe2, 0x37, 0x5c, 0x14, 0x98, 0x10, 0x87, 0x12, 0x98, 0x49, 0x5e, 0xe0, 0x26, 0x15,
+	0x4b, 0x31, 0x18, 0x77, 0x18, 0xc6, 0x87, 0x1f, 0x42, 0x62, 0x42, 0x46, 0xc3, 0x70, 0x8e, 0x79,
+	0x2e, 0x56, 0x59, 0x4e, 0x3c, 0x7a, 0x05, 0xc1, 0x57, 0xe4, 0xb2, 0x88, 0x91, 0x17, 0xe4, 0x72,
+	0xc0, 0x7c, 0x1d, 0xe7, 0x0b, 0x29, 0x62, 0x24, 0x3e, 0x7d, 0x01, 0xd3, 0x75, 0x76, 0x16, 0xe3,
+	0x61, 0x77, 0xb6, 0x2a, 0xc4, 0x17, 0xb1, 0xe0, 0x85, 0x58, 0x65, 0x64, 0x72, 0xfb, 0x13, 0xfc,
+	0xe3, 0x5f, 0xa0, 0x3e, 0xb8, 0xab, 0xef, 0xe4, 0x82, 0xde, 0x00, 0x11, 0xd9, 0x3d, 0x4f, 0x45,
+	0xb2, 0xe1, 0xf2, 0x6e, 0xbd, 0xc4, 0xac, 0x20, 0xce, 0x71, 0x15, 0xbf, 0xe7, 0x22, 0xe5, 0x71,
+	0x8a, 0xc4, 0xa5, 0xaf, 0xe0, 0x65, 0x82, 0x3c, 0x49, 0x45, 0x86, 0x1b, 0x7c, 0x58, 0x20, 0x26,
+	0x4f, 0xe7, 0x89, 0xac, 0x40, 0x99, 0xf1, 0x94, 0x78, 0xbf, 0x7c, 0xfb, 0x78, 0x3e, 0xff, 0x1b,
+	0x00, 0xf5, 0x82, 0xbc, 0x81, 0x4d, 0x02, 0x00, 0x00,
 }
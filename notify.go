@@ -0,0 +1,464 @@
+package rtreq
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+
+	pb "github.com/bbengfort/rtreq/msg"
+	"github.com/gogo/protobuf/proto"
+	zmq "github.com/pebbe/zmq4"
+)
+
+// NotifyKeepalive is how often clients renew their subscription to server
+// notifications. Servers forget subscribers that haven't renewed their
+// subscription within three keepalive periods.
+const NotifyKeepalive = 10 * time.Second
+
+// NotificationBuffer is the number of notifications a client buffers before
+// new notifications are dropped.
+const NotificationBuffer = 64
+
+//===========================================================================
+// Server Notifications
+//===========================================================================
+
+// Notifier pushes unsolicited notifications from a server to its clients on
+// a ROUTER socket bound to a separate address. Clients subscribe on connect
+// and are addressed by their identity; notifications may be broadcast to all
+// subscribers or targeted to a single client. The ROUTER socket is owned by
+// a go routine and notifications are queued to it on an in process socket,
+// so the notifier may be used by multiple go routines.
+type Notifier struct {
+	sync.Mutex
+	transporter *Transporter         // the server the notifications are sent from
+	addr        string               // address the notification socket is bound to
+	sock        *zmq.Socket          // ROUTER socket owned by the notifier go routine
+	queue       *zmq.Socket          // PUSH socket that queues notifications (guarded by mutex)
+	inbox       *zmq.Socket          // PULL socket the go routine receives notifications on
+	subscribers map[string]time.Time // subscribed client identities and when they renewed
+	stop        chan struct{}        // closed to stop the notifier go routine
+	done        chan error           // receives the result of the notifier go routine
+}
+
+// Create a notifier for the server that binds to the address.
+func newNotifier(t *Transporter, addr string) *Notifier {
+	return &Notifier{
+		transporter: t,
+		addr:        fmt.Sprintf("tcp://%s", addr),
+		subscribers: make(map[string]time.Time),
+	}
+}
+
+// Bind the notification socket and start the go routine that sends queued
+// notifications and handles subscriptions.
+func (n *Notifier) start() (err error) {
+	t := n.transporter
+	if n.sock, err = t.context.NewSocket(zmq.ROUTER); err != nil {
+		return WrapError("could not create notification socket", err)
+	}
+
+	// Report clients that have disconnected rather than silently dropping
+	if err = n.sock.SetRouterMandatory(1); err != nil {
+		return WrapError("could not set router mandatory", err)
+	}
+
+	if t.security != nil {
+		if err = t.security.Server(n.sock); err != nil {
+			return err
+		}
+	}
+
+	if err = n.sock.Bind(n.addr); err != nil {
+		return WrapError("could not bind '%s'", err, n.addr)
+	}
+
+	endpoint := fmt.Sprintf("inproc://rtreq-notify-%p", n)
+	if n.inbox, err = t.context.NewSocket(zmq.PULL); err != nil {
+		return err
+	}
+
+	if err = n.inbox.Bind(endpoint); err != nil {
+		return WrapError("could not bind '%s'", err, endpoint)
+	}
+
+	if n.queue, err = t.context.NewSocket(zmq.PUSH); err != nil {
+		return err
+	}
+
+	if err = n.queue.Connect(endpoint); err != nil {
+		return WrapError("could not connect to '%s'", err, endpoint)
+	}
+
+	n.stop = make(chan struct{})
+	n.done = make(chan error, 1)
+	go func() { n.done <- n.run() }()
+
+	status("sending notifications on %s\n", n.addr)
+	return nil
+}
+
+// Close the notifier after sending any queued notifications.
+func (n *Notifier) close() error {
+	n.Lock()
+	close(n.stop)
+	n.queue.SendBytes(nil, zmq.DONTWAIT)
+	n.Unlock()
+
+	err := <-n.done
+
+	n.Lock()
+	defer n.Unlock()
+	n.queue.SetLinger(0)
+	if cerr := n.queue.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Subscribers returns the identities of the clients that are subscribed.
+func (n *Notifier) Subscribers() []string {
+	n.Lock()
+	defer n.Unlock()
+
+	identities := make([]string, 0, len(n.subscribers))
+	for identity := range n.subscribers {
+		identities = append(identities, identity)
+	}
+	return identities
+}
+
+// Queue a notification to the client with the identity, or to all clients
+// if the identity is empty. The notification is queued without blocking,
+// since the notifier go routine requires the lock to handle subscriptions;
+// if the queue is full the notification is dropped with ErrNotifyQueueFull.
+func (n *Notifier) enqueue(identity, message string) error {
+	n.Lock()
+	defer n.Unlock()
+
+	select {
+	case <-n.stop:
+		return ErrNoNotifications
+	default:
+	}
+
+	if identity != "" {
+		if _, ok := n.subscribers[identity]; !ok {
+			return WrapError("could not notify %s", ErrNotSubscribed, identity)
+		}
+	}
+
+	data, err := n.transporter.marshal(&pb.BasicMessage{
+		Sender:   n.transporter.name,
+		Message:  message,
+		Type:     pb.Type_NOTIFICATION,
+		Identity: identity,
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err = n.queue.SendMessageDontwait(identity, data); err != nil {
+		if zmq.AsErrno(err) == zmq.Errno(syscall.EAGAIN) {
+			return ErrNotifyQueueFull
+		}
+		return err
+	}
+	return nil
+}
+
+// Send queued notifications and handle subscriptions until stopped, then
+// send any notifications that remain in the queue.
+func (n *Notifier) run() error {
+	defer n.inbox.Close()
+	defer n.sock.Close()
+
+	poller := zmq.NewPoller()
+	poller.Add(n.sock, zmq.POLLIN)
+	poller.Add(n.inbox, zmq.POLLIN)
+
+	for {
+		polled, err := poller.Poll(NotifyKeepalive)
+		if err != nil {
+			if zmq.AsErrno(err) == zmq.ETERM {
+				return nil
+			}
+			return err
+		}
+
+		for _, item := range polled {
+			switch item.Socket {
+			case n.inbox:
+				frames, err := n.inbox.RecvMessageBytes(0)
+				if err != nil || len(frames) != 2 {
+					continue
+				}
+				n.deliver(string(frames[0]), frames[1])
+			case n.sock:
+				frames, err := n.sock.RecvMessageBytes(0)
+				if err != nil {
+					warn("could not receive subscription: %s", err)
+					continue
+				}
+				n.subscribe(string(frames[0]), frames[len(frames)-1])
+			}
+		}
+
+		select {
+		case <-n.stop:
+			n.drain()
+			return nil
+		default:
+			n.expire(time.Now())
+		}
+	}
+}
+
+// Send a notification to the client with the identity, or to all subscribed
+// clients if the identity is empty. Clients that have disconnected are
+// unsubscribed.
+func (n *Notifier) deliver(identity string, data []byte) {
+	identities := []string{identity}
+	if identity == "" {
+		identities = n.Subscribers()
+	}
+
+	for _, identity := range identities {
+		_, err := n.sock.SendMessageDontwait(identity, "", data)
+		if err == nil {
+			continue
+		}
+
+		if zmq.AsErrno(err) == zmq.EHOSTUNREACH {
+			debug("unsubscribing disconnected client %s", identity)
+			n.Lock()
+			delete(n.subscribers, identity)
+			n.Unlock()
+			continue
+		}
+		warn("could not notify %s: %s", identity, err)
+	}
+}
+
+// Send the notifications remaining in the queue without blocking.
+func (n *Notifier) drain() {
+	for {
+		frames, err := n.inbox.RecvMessageBytes(zmq.DONTWAIT)
+		if err != nil {
+			return
+		}
+
+		if len(frames) == 2 {
+			n.deliver(string(frames[0]), frames[1])
+		}
+	}
+}
+
+// Handle a subscription request from the client with the routing identity.
+func (n *Notifier) subscribe(identity string, data []byte) {
+	message := new(pb.BasicMessage)
+	if err := proto.Unmarshal(data, message); err != nil {
+		warn("could not parse subscription: %s", err)
+		return
+	}
+
+	if signer := n.transporter.signer; signer != nil {
+		if err := signer.Verify(message); err != nil {
+			warn("rejecting subscription from %s: %s", message.Sender, err)
+			return
+		}
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	switch message.Type {
+	case pb.Type_SUBSCRIBE:
+		if _, ok := n.subscribers[identity]; !ok {
+			info("%s subscribed to notifications", identity)
+		}
+		n.subscribers[identity] = time.Now()
+	case pb.Type_UNSUBSCRIBE:
+		delete(n.subscribers, identity)
+		info("%s unsubscribed from notifications", identity)
+	default:
+		debug("unexpected %s message on notification socket", message.Type)
+	}
+}
+
+// Forget subscribers that have not renewed their subscription.
+func (n *Notifier) expire(now time.Time) {
+	n.Lock()
+	defer n.Unlock()
+
+	for identity, renewed := range n.subscribers {
+		if now.Sub(renewed) > 3*NotifyKeepalive {
+			delete(n.subscribers, identity)
+			debug("subscription of %s expired", identity)
+		}
+	}
+}
+
+//===========================================================================
+// Server Notification Methods
+//===========================================================================
+
+// SetNotifications specifies the address to send notifications to clients
+// on. Must be called before the server is run.
+func (t *Transporter) SetNotifications(addr string) {
+	t.notifier = newNotifier(t, addr)
+}
+
+// Broadcast a notification to all subscribed clients.
+func (t *Transporter) Broadcast(message string) error {
+	if t.notifier == nil {
+		return ErrNoNotifications
+	}
+	return t.notifier.enqueue("", message)
+}
+
+// Notify the client with the identity, returning an error wrapping
+// ErrNotSubscribed if the client is not subscribed to notifications.
+func (t *Transporter) Notify(identity, message string) error {
+	if t.notifier == nil {
+		return ErrNoNotifications
+	}
+
+	if identity == "" {
+		return WrapError("no client identity specified", ErrNotSubscribed)
+	}
+	return t.notifier.enqueue(identity, message)
+}
+
+//===========================================================================
+// Client Subscriptions
+//===========================================================================
+
+// Subscription receives notifications from a server on a companion DEALER
+// socket with the identity of the client, renewing the subscription every
+// NotifyKeepalive so that it survives server restarts.
+type Subscription struct {
+	transporter   *Transporter          // the client that is subscribed
+	identity      string                // the identity of the client
+	addr          string                // address of the notification socket
+	sock          *zmq.Socket           // DEALER socket owned by the go routine
+	notifications chan *pb.BasicMessage // notifications received from the server
+	stop          chan struct{}         // closed to stop the subscription go routine
+	done          chan error            // receives the result of the go routine
+}
+
+// Connect to the notification socket of the server and subscribe.
+func (s *Subscription) start() (err error) {
+	t := s.transporter
+	if s.sock, err = t.context.NewSocket(zmq.DEALER); err != nil {
+		return WrapError("could not create subscription socket", err)
+	}
+
+	s.sock.SetLinger(0)
+	s.sock.SetIdentity(s.identity)
+
+	if t.security != nil {
+		if err = t.security.Client(s.sock); err != nil {
+			return err
+		}
+	}
+
+	if err = s.sock.Connect(s.addr); err != nil {
+		return WrapError("could not connect to '%s'", err, s.addr)
+	}
+
+	s.notifications = make(chan *pb.BasicMessage, NotificationBuffer)
+	s.stop = make(chan struct{})
+	s.done = make(chan error, 1)
+	go func() { s.done <- s.run() }()
+
+	info("subscribed to notifications from %s", s.addr)
+	return nil
+}
+
+// Unsubscribe, close the socket and wait for the go routine to exit.
+func (s *Subscription) close() error {
+	close(s.stop)
+	return <-s.done
+}
+
+// Receive notifications until stopped, renewing the subscription.
+func (s *Subscription) run() error {
+	defer close(s.notifications)
+	defer s.sock.Close()
+
+	poller := zmq.NewPoller()
+	poller.Add(s.sock, zmq.POLLIN)
+
+	renew := time.Now()
+	for {
+		select {
+		case <-s.stop:
+			s.send(pb.Type_UNSUBSCRIBE)
+			return nil
+		default:
+		}
+
+		if now := time.Now(); !now.Before(renew) {
+			s.send(pb.Type_SUBSCRIBE)
+			renew = now.Add(NotifyKeepalive)
+		}
+
+		polled, err := poller.Poll(HeartbeatTick)
+		if err != nil {
+			if zmq.AsErrno(err) == zmq.ETERM {
+				return nil
+			}
+			return err
+		}
+
+		if len(polled) > 0 {
+			frames, err := s.sock.RecvMessageBytes(0)
+			if err != nil {
+				warn("could not receive notification: %s", err)
+				continue
+			}
+			s.receive(frames[len(frames)-1])
+		}
+	}
+}
+
+// Send a subscription request with an empty delimiter like a REQ socket.
+func (s *Subscription) send(kind pb.Type) {
+	data, err := s.transporter.marshal(&pb.BasicMessage{
+		Sender:   s.transporter.name,
+		Type:     kind,
+		Identity: s.identity,
+	})
+	if err != nil {
+		warn("could not marshal subscription: %s", err)
+		return
+	}
+
+	if _, err = s.sock.SendMessageDontwait("", data); err != nil {
+		trace("could not send subscription: %s", err)
+	}
+}
+
+// Parse a notification and deliver it, dropping it if the buffer is full.
+func (s *Subscription) receive(data []byte) {
+	message := new(pb.BasicMessage)
+	if err := proto.Unmarshal(data, message); err != nil {
+		warn("could not parse notification: %s", err)
+		return
+	}
+
+	if signer := s.transporter.signer; signer != nil {
+		if err := signer.Verify(message); err != nil {
+			warn("could not verify notification from %s: %s", message.Sender, err)
+			return
+		}
+	}
+
+	select {
+	case s.notifications <- message:
+	default:
+		warn("notification buffer full, dropped notification from %s", message.Sender)
+	}
+}
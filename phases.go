@@ -0,0 +1,64 @@
+package rtreq
+
+import "time"
+
+//===========================================================================
+// Benchmark Phases
+//===========================================================================
+
+// Phases are the warmup before and the cooldown after the measured duration
+// of a benchmark. Requests are sent throughout, but only requests sent during
+// the measurement window between the phases are recorded, so that connecting,
+// allocating buffers and growing the heap do not skew the results, and so
+// that the last measured requests are not sent to an idle server. The zero
+// value measures the entire benchmark.
+type Phases struct {
+	Warmup   time.Duration // time requests are sent before measuring
+	Cooldown time.Duration // time requests are sent after measuring
+}
+
+// Total returns how long a benchmark that measures the duration runs for.
+func (p Phases) Total(duration time.Duration) time.Duration {
+	return p.Warmup + duration + p.Cooldown
+}
+
+// Serialize the phases into the results.
+func (p Phases) Serialize(data map[string]interface{}) {
+	data["warmup (nsec)"] = p.Warmup.Nanoseconds()
+	data["cooldown (nsec)"] = p.Cooldown.Nanoseconds()
+}
+
+// Returns the measurement window of a benchmark that starts now.
+func (p Phases) window(duration time.Duration) window {
+	start := time.Now().Add(p.Warmup)
+	return window{start: start, end: start.Add(duration)}
+}
+
+// The period of a benchmark in which requests are recorded.
+type window struct {
+	start time.Time // end of the warmup
+	end   time.Time // start of the cooldown
+}
+
+// Returns true if a request sent at the time is recorded; the zero window
+// records every request.
+func (w window) contains(t time.Time) bool {
+	if w.end.IsZero() {
+		return true
+	}
+	return !t.Before(w.start) && t.Before(w.end)
+}
+
+// Returns how much of the window has passed, which is its length once the
+// cooldown has started.
+func (w window) elapsed() time.Duration {
+	now := time.Now()
+	if now.After(w.end) {
+		now = w.end
+	}
+
+	if now.Before(w.start) {
+		return 0
+	}
+	return now.Sub(w.start)
+}
@@ -0,0 +1,291 @@
+package rtreq
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	zmq "github.com/pebbe/zmq4"
+)
+
+// DefaultPoolSize is the maximum number of clients in a pool if not specified.
+const DefaultPoolSize = 16
+
+// NewClientPool creates a pool of at most size clients that connect to the
+// server at addr. If size is 0, DefaultPoolSize is used. If context is nil,
+// it also creates a context that will be shared by all the clients.
+func NewClientPool(addr, name string, size int, context *zmq.Context) (p *ClientPool, err error) {
+	if context == nil {
+		if context, err = zmq.NewContext(); err != nil {
+			return nil, WrapError("could not create zmq context", err)
+		}
+	}
+
+	if size <= 0 {
+		size = DefaultPoolSize
+	}
+
+	p = &ClientPool{
+		addr:    addr,
+		name:    name,
+		context: context,
+		size:    size,
+		tokens:  make(chan struct{}, size),
+		idle:    make([]*Client, 0, size),
+	}
+	return p, nil
+}
+
+//===========================================================================
+// Client Pool
+//===========================================================================
+
+// ClientPool hands out clients to go routines that need to communicate with
+// the server concurrently. Clients are created lazily on a shared context up
+// to the maximum size of the pool; if all clients are in use, Get blocks
+// until one is returned. Clients that are returned after an error that may
+// have left their socket in a bad state are reset before they are reused.
+type ClientPool struct {
+	sync.Mutex
+	addr     string          // address of the server clients connect to
+	name     string          // name of the clients in the pool
+	context  *zmq.Context    // context shared by all clients
+	security *Security       // security configuration applied to new clients
+	signer   *Signer         // message signer applied to new clients
+	breaker  *CircuitBreaker // circuit breaker shared by all clients
+	interval time.Duration   // interval of heartbeats sent by new clients, 0 if none
+	liveness int             // missed heartbeats before a server is dead
+	size     int             // maximum number of clients in the pool
+	tokens   chan struct{}   // semaphore held by each client in use
+	idle     []*Client       // clients that are connected and available
+	live     int             // number of clients that are connected
+	closed   bool            // if the pool has been closed
+	stats    PoolStats       // counters of pool operations
+}
+
+// PoolStats reports the state of the pool and counts of its operations.
+type PoolStats struct {
+	MaxSize   int    `json:"max_size"`  // maximum number of clients
+	Live      int    `json:"live"`      // number of connected clients
+	Idle      int    `json:"idle"`      // number of clients available
+	InUse     int    `json:"in_use"`    // number of clients handed out
+	Created   uint64 `json:"created"`   // number of clients created
+	Acquired  uint64 `json:"acquired"`  // number of times a client was handed out
+	Waits     uint64 `json:"waits"`     // number of times Get blocked on a full pool
+	Resets    uint64 `json:"resets"`    // number of broken clients that were reset
+	Discarded uint64 `json:"discarded"` // number of clients that could not be reset
+}
+
+// SetSecurity configures security on all clients created by the pool.
+func (p *ClientPool) SetSecurity(security *Security) {
+	p.Lock()
+	defer p.Unlock()
+	p.security = security
+}
+
+// SetSigner configures message signatures on all clients created by the pool.
+func (p *ClientPool) SetSigner(signer *Signer) {
+	p.Lock()
+	defer p.Unlock()
+	p.signer = signer
+}
+
+// SetCircuitBreaker configures a circuit breaker shared by all clients in
+// the pool, since they all connect to the same server.
+func (p *ClientPool) SetCircuitBreaker(breaker *CircuitBreaker) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.breaker = breaker
+	for _, client := range p.idle {
+		client.SetCircuitBreaker(breaker)
+	}
+}
+
+// SetHeartbeat configures heartbeats on all clients created by the pool.
+func (p *ClientPool) SetHeartbeat(interval time.Duration, liveness int) {
+	p.Lock()
+	defer p.Unlock()
+	p.interval = interval
+	p.liveness = liveness
+}
+
+// Get a client from the pool, creating and connecting it if there are no
+// idle clients. Blocks if the maximum number of clients are in use. The
+// client must be returned to the pool with Put.
+func (p *ClientPool) Get() (*Client, error) {
+	select {
+	case p.tokens <- struct{}{}:
+	default:
+		p.Lock()
+		p.stats.Waits++
+		p.Unlock()
+		p.tokens <- struct{}{}
+	}
+
+	client, err := p.acquire()
+	if err != nil {
+		<-p.tokens
+		return nil, err
+	}
+	return client, nil
+}
+
+// Put a client back into the pool along with the error returned by the last
+// operation on it, if any. If the error indicates the socket may be broken,
+// the client is reset, or discarded if it cannot be reset.
+func (p *ClientPool) Put(client *Client, err error) {
+	defer func() { <-p.tokens }()
+
+	p.Lock()
+	defer p.Unlock()
+
+	if p.closed {
+		p.discard(client)
+		return
+	}
+
+	if broken(err) {
+		debug("resetting pooled client %s after error: %s", client.identity, err)
+		if rerr := client.Reset(); rerr != nil {
+			warn("could not reset pooled client: %s", rerr)
+			p.stats.Discarded++
+			p.discard(client)
+			return
+		}
+		p.stats.Resets++
+	}
+
+	p.idle = append(p.idle, client)
+}
+
+// Send a message using a client from the pool, returning it afterward.
+func (p *ClientPool) Send(message string, policy *RetryPolicy) error {
+	client, err := p.Get()
+	if err != nil {
+		return err
+	}
+
+	err = client.Send(message, policy)
+	p.Put(client, err)
+	return err
+}
+
+// Stats returns a snapshot of the pool statistics.
+func (p *ClientPool) Stats() PoolStats {
+	p.Lock()
+	defer p.Unlock()
+
+	stats := p.stats
+	stats.MaxSize = p.size
+	stats.Live = p.live
+	stats.Idle = len(p.idle)
+	stats.InUse = p.live - len(p.idle)
+	return stats
+}
+
+// String returns a summary of the pool statistics.
+func (p *ClientPool) String() string {
+	s := p.Stats()
+	return fmt.Sprintf(
+		"%d/%d clients in use, %d created, %d acquired, %d waits, %d resets, %d discarded",
+		s.InUse, s.MaxSize, s.Created, s.Acquired, s.Waits, s.Resets, s.Discarded,
+	)
+}
+
+// Close all idle clients and prevent any more clients from being handed
+// out; clients that are in use are closed when they are returned.
+func (p *ClientPool) Close() (err error) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.closed = true
+	for _, client := range p.idle {
+		if cerr := client.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		p.live--
+	}
+	p.idle = nil
+	return err
+}
+
+// Shutdown the ZMQ context shared by the clients permanently, all clients
+// must be closed first.
+func (p *ClientPool) Shutdown() error {
+	if err := p.context.Term(); err != nil {
+		return err
+	}
+
+	return zmq.Term()
+}
+
+// Take an idle client or create and connect a new one.
+func (p *ClientPool) acquire() (*Client, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.closed {
+		return nil, ErrPoolClosed
+	}
+
+	if n := len(p.idle); n > 0 {
+		client := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.stats.Acquired++
+		return client, nil
+	}
+
+	client, err := NewClient(p.addr, p.name, p.context)
+	if err != nil {
+		return nil, err
+	}
+
+	client.SetSecurity(p.security)
+	client.SetSigner(p.signer)
+	client.SetCircuitBreaker(p.breaker)
+	if err = client.Connect(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	if p.interval > 0 {
+		if err = client.StartHeartbeat(p.interval, p.liveness); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+
+	p.live++
+	p.stats.Created++
+	p.stats.Acquired++
+	return client, nil
+}
+
+// Close a client and remove it from the pool; must hold the lock.
+func (p *ClientPool) discard(client *Client) {
+	if err := client.Close(); err != nil {
+		debug("could not close discarded client: %s", err)
+	}
+	p.live--
+}
+
+// Determine if an error returned by Send may have left the client socket in
+// a bad state. Errors from replies mean the REQ socket received a reply and
+// is ready to send again, and dropped messages have already reset the
+// socket; any other error means it might not be.
+func broken(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var serr *StatusError
+	switch {
+	case errors.As(err, &serr):
+		return false
+	case errors.Is(err, ErrRejected), errors.Is(err, ErrRateLimited), errors.Is(err, ErrCircuitOpen), errors.Is(err, ErrServerDead), errors.Is(err, ErrMessageDropped):
+		return false
+	}
+	return true
+}
@@ -0,0 +1,332 @@
+package rtreq
+
+import (
+	"fmt"
+	"time"
+
+	pb "github.com/bbengfort/rtreq/msg"
+	"github.com/gogo/protobuf/proto"
+	zmq "github.com/pebbe/zmq4"
+)
+
+// Default addresses of the publish/subscribe service.
+const (
+	DefaultPublishAddr   = "*:4159"
+	DefaultSubscribeAddr = "*:4160"
+)
+
+// DefaultJoinDelay is how long a publisher should wait after connecting
+// before it publishes, since messages published before subscriptions reach
+// the publisher are dropped.
+const DefaultJoinDelay = 250 * time.Millisecond
+
+//===========================================================================
+// Publish/Subscribe Broker
+//===========================================================================
+
+// Broker forwards messages from publishers to subscribers on behalf of a
+// server. Publishers connect PUB sockets to the XSUB socket of the broker and
+// subscribers connect SUB sockets to its XPUB socket; subscriptions flow back
+// to the publishers so that messages are only sent for subscribed topics.
+// Messages are two frames, the topic and the protocol buffers message.
+type Broker struct {
+	transporter *Transporter // the server the broker runs in
+	pubAddr     string       // address publishers connect to
+	subAddr     string       // address subscribers connect to
+	xsub        *zmq.Socket  // XSUB socket that receives from publishers
+	xpub        *zmq.Socket  // XPUB socket that sends to subscribers
+}
+
+// Create a broker for the server that binds to the addresses.
+func newBroker(t *Transporter, pubAddr, subAddr string) *Broker {
+	return &Broker{
+		transporter: t,
+		pubAddr:     fmt.Sprintf("tcp://%s", pubAddr),
+		subAddr:     fmt.Sprintf("tcp://%s", subAddr),
+	}
+}
+
+// Bind the broker sockets and start forwarding messages.
+func (b *Broker) start() (err error) {
+	t := b.transporter
+	if b.xsub, err = t.context.NewSocket(zmq.XSUB); err != nil {
+		return WrapError("could not create XSUB socket", err)
+	}
+
+	if b.xpub, err = t.context.NewSocket(zmq.XPUB); err != nil {
+		return WrapError("could not create XPUB socket", err)
+	}
+
+	// Pass every subscription to the broker so they can be counted
+	if err = b.xpub.SetXpubVerbose(1); err != nil {
+		return WrapError("could not set xpub verbose", err)
+	}
+
+	if t.security != nil {
+		if err = t.security.Server(b.xsub); err != nil {
+			return err
+		}
+
+		if err = t.security.Server(b.xpub); err != nil {
+			return err
+		}
+	}
+
+	if err = b.xsub.Bind(b.pubAddr); err != nil {
+		return WrapError("could not bind '%s'", err, b.pubAddr)
+	}
+
+	if err = b.xpub.Bind(b.subAddr); err != nil {
+		return WrapError("could not bind '%s'", err, b.subAddr)
+	}
+
+	go func() {
+		if err := b.run(); err != nil {
+			warn("pubsub broker stopped: %s", err)
+		}
+	}()
+
+	status("publishing from %s to %s\n", b.pubAddr, b.subAddr)
+	return nil
+}
+
+// Forward messages and subscriptions like zmq.Proxy, counting them, until
+// the context is terminated.
+func (b *Broker) run() error {
+	defer b.xsub.Close()
+	defer b.xpub.Close()
+
+	poller := zmq.NewPoller()
+	poller.Add(b.xsub, zmq.POLLIN)
+	poller.Add(b.xpub, zmq.POLLIN)
+
+	for {
+		polled, err := poller.Poll(-1)
+		if err != nil {
+			if zmq.AsErrno(err) == zmq.ETERM {
+				return nil
+			}
+			return err
+		}
+
+		for _, item := range polled {
+			switch item.Socket {
+			case b.xsub:
+				frames, err := b.xsub.RecvMessageBytes(0)
+				if err != nil {
+					return err
+				}
+
+				if _, err = b.xpub.SendMessage(frames); err != nil {
+					return err
+				}
+				b.transporter.metrics.Publish()
+			case b.xpub:
+				frames, err := b.xpub.RecvMessageBytes(0)
+				if err != nil {
+					return err
+				}
+
+				b.subscription(frames[0])
+				if _, err = b.xsub.SendMessage(frames); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// Count a subscription message, which is a one byte flag (1 to subscribe
+// and 0 to unsubscribe) followed by the topic.
+func (b *Broker) subscription(frame []byte) {
+	if len(frame) == 0 {
+		return
+	}
+
+	topic := string(frame[1:])
+	switch frame[0] {
+	case 1:
+		b.transporter.metrics.Subscribe(topic)
+		debug("subscription to topic %q", topic)
+	case 0:
+		b.transporter.metrics.Unsubscribe(topic)
+		debug("no more subscribers to topic %q", topic)
+	}
+}
+
+// SetPubSub specifies the addresses of the publish/subscribe service that
+// publishers and subscribers connect to. Must be called before the server is
+// run.
+func (t *Transporter) SetPubSub(pubAddr, subAddr string) {
+	t.broker = newBroker(t, pubAddr, subAddr)
+}
+
+//===========================================================================
+// Publishers
+//===========================================================================
+
+// NewPublisher creates a new rtreq.Publisher that connects to the publish
+// address of a server. If context is nil, it also creates a context that
+// will be managed by the publisher.
+func NewPublisher(addr, name string, context *zmq.Context) (p *Publisher, err error) {
+	if context == nil {
+		if context, err = zmq.NewContext(); err != nil {
+			return nil, WrapError("could not create zmq context", err)
+		}
+	}
+
+	p = new(Publisher)
+	p.Init(addr, name, context)
+	return p, nil
+}
+
+// Publisher publishes messages to topics using a PUB socket.
+type Publisher struct {
+	Transporter
+}
+
+// Connect to the publish address of the server. Messages published before
+// the subscriptions of subscribers have been received are dropped, so wait
+// for DefaultJoinDelay before publishing.
+func (p *Publisher) Connect() (err error) {
+	if p.sock, err = p.context.NewSocket(zmq.PUB); err != nil {
+		return err
+	}
+
+	if p.security != nil {
+		if err = p.security.Client(p.sock); err != nil {
+			return err
+		}
+	}
+
+	if err = p.sock.Connect(p.addr); err != nil {
+		return err
+	}
+
+	info("connected publisher to %s\n", p.addr)
+	return nil
+}
+
+// Publish a message to the topic.
+func (p *Publisher) Publish(topic, message string) error {
+	data, err := p.marshal(&pb.BasicMessage{Sender: p.name, Message: message})
+	if err != nil {
+		return err
+	}
+
+	nbytes, err := p.sock.SendMessage(topic, data)
+	if err != nil {
+		return err
+	}
+
+	p.nBytes += uint64(nbytes)
+	p.nSent++
+	return nil
+}
+
+//===========================================================================
+// Subscribers
+//===========================================================================
+
+// NewSubscriber creates a new rtreq.Subscriber that connects to the
+// subscribe address of a server. If context is nil, it also creates a
+// context that will be managed by the subscriber.
+func NewSubscriber(addr, name string, context *zmq.Context) (s *Subscriber, err error) {
+	if context == nil {
+		if context, err = zmq.NewContext(); err != nil {
+			return nil, WrapError("could not create zmq context", err)
+		}
+	}
+
+	s = new(Subscriber)
+	s.Init(addr, name, context)
+	return s, nil
+}
+
+// Subscriber receives messages published to topics using a SUB socket.
+type Subscriber struct {
+	Transporter
+}
+
+// Connect to the subscribe address of the server.
+func (s *Subscriber) Connect() (err error) {
+	if s.sock, err = s.context.NewSocket(zmq.SUB); err != nil {
+		return err
+	}
+
+	if s.security != nil {
+		if err = s.security.Client(s.sock); err != nil {
+			return err
+		}
+	}
+
+	if err = s.sock.Connect(s.addr); err != nil {
+		return err
+	}
+
+	info("connected subscriber to %s\n", s.addr)
+	return nil
+}
+
+// Subscribe to messages published to topics that begin with any of the
+// prefixes; the empty prefix subscribes to all topics.
+func (s *Subscriber) Subscribe(prefixes ...string) error {
+	for _, prefix := range prefixes {
+		if err := s.sock.SetSubscribe(prefix); err != nil {
+			return WrapError("could not subscribe to %q", err, prefix)
+		}
+	}
+	return nil
+}
+
+// Unsubscribe from topics previously subscribed to.
+func (s *Subscriber) Unsubscribe(prefixes ...string) error {
+	for _, prefix := range prefixes {
+		if err := s.sock.SetUnsubscribe(prefix); err != nil {
+			return WrapError("could not unsubscribe from %q", err, prefix)
+		}
+	}
+	return nil
+}
+
+// Recv the next published message and its topic, waiting at most timeout
+// or forever if timeout is negative. Returns ErrRecvTimeout if no message
+// was published before the timeout.
+func (s *Subscriber) Recv(timeout time.Duration) (string, *pb.BasicMessage, error) {
+	if timeout >= 0 {
+		poller := zmq.NewPoller()
+		poller.Add(s.sock, zmq.POLLIN)
+		polled, err := poller.Poll(timeout)
+		if err != nil {
+			return "", nil, err
+		}
+
+		if len(polled) == 0 {
+			return "", nil, ErrRecvTimeout
+		}
+	}
+
+	frames, err := s.sock.RecvMessageBytes(0)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(frames) != 2 {
+		return "", nil, fmt.Errorf("expected 2 frames in published message, received %d", len(frames))
+	}
+
+	topic := string(frames[0])
+	message := new(pb.BasicMessage)
+	if err = proto.Unmarshal(frames[1], message); err != nil {
+		return topic, nil, err
+	}
+
+	if s.signer != nil {
+		if err = s.signer.Verify(message); err != nil {
+			return topic, message, WrapError("could not verify message from %s", err, message.Sender)
+		}
+	}
+
+	s.nRecv++
+	return topic, message, nil
+}
@@ -0,0 +1,162 @@
+package rtreq
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//===========================================================================
+// Per-Client Rate Limits
+//===========================================================================
+
+// RateLimit specifies the sustained number of messages per second a client
+// may send and the burst of messages it may send above that rate. A rate of
+// zero means the client is not limited.
+type RateLimit struct {
+	Rate  float64 // messages per second
+	Burst int     // maximum number of tokens in the bucket
+}
+
+// ParseRateLimit parses a limit in the form rate[:burst], e.g. "100:10". If
+// the burst is omitted, it defaults to the rate (at least 1).
+func ParseRateLimit(s string) (limit RateLimit, err error) {
+	parts := strings.SplitN(s, ":", 2)
+	if limit.Rate, err = strconv.ParseFloat(parts[0], 64); err != nil {
+		return limit, fmt.Errorf("could not parse rate '%s'", parts[0])
+	}
+
+	if len(parts) == 2 {
+		if limit.Burst, err = strconv.Atoi(parts[1]); err != nil {
+			return limit, fmt.Errorf("could not parse burst '%s'", parts[1])
+		}
+	}
+
+	return limit, nil
+}
+
+// RateLimitSweep is how often the rate limiter forgets the buckets of idle
+// clients, whose buckets have refilled and so are the same as new ones.
+const RateLimitSweep = time.Minute
+
+// RateLimiter maintains a token bucket for every client identity. Clients
+// use the default limit unless an override has been specified for their
+// name, which is shared by every connection of the client.
+type RateLimiter struct {
+	sync.Mutex
+	defaults  RateLimit            // limit applied to all clients
+	overrides map[string]RateLimit // client specific limits by name
+	buckets   map[string]*bucket   // token bucket for each client identity seen
+	swept     time.Time            // last time idle buckets were evicted
+}
+
+// NewRateLimiter creates a rate limiter with the default client limit.
+func NewRateLimiter(defaults RateLimit) *RateLimiter {
+	return &RateLimiter{
+		defaults:  defaults,
+		overrides: make(map[string]RateLimit),
+		buckets:   make(map[string]*bucket),
+		swept:     time.Now(),
+	}
+}
+
+// Override the default limit for the clients with the specified name.
+func (r *RateLimiter) Override(name string, limit RateLimit) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.overrides[name] = limit
+	for identity, b := range r.buckets {
+		if b.name == name {
+			delete(r.buckets, identity)
+		}
+	}
+}
+
+// Allow takes a token from the bucket of the client identity, returning true
+// if the client may send the message. If not, it returns how long the client
+// should wait before a token will be available. The limit of the bucket is
+// the override for the name of the client, if any.
+func (r *RateLimiter) Allow(identity, name string) (bool, time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.swept) >= RateLimitSweep {
+		r.sweep(now)
+	}
+
+	b, ok := r.buckets[identity]
+	if !ok {
+		limit, ok := r.overrides[name]
+		if !ok {
+			limit = r.defaults
+		}
+
+		b = newBucket(name, limit, now)
+		r.buckets[identity] = b
+	}
+
+	return b.take(now)
+}
+
+// Evict the buckets that have refilled since they were last used.
+func (r *RateLimiter) sweep(now time.Time) {
+	for identity, b := range r.buckets {
+		if b.full(now) {
+			delete(r.buckets, identity)
+		}
+	}
+	r.swept = now
+}
+
+// A token bucket that refills continuously at the rate of the limit.
+type bucket struct {
+	name   string    // name of the client the bucket limits
+	limit  RateLimit // rate and burst of the bucket
+	tokens float64   // number of tokens currently available
+	last   time.Time // last time the bucket was refilled
+}
+
+func newBucket(name string, limit RateLimit, now time.Time) *bucket {
+	if limit.Burst < 1 {
+		limit.Burst = int(limit.Rate)
+		if limit.Burst < 1 {
+			limit.Burst = 1
+		}
+	}
+
+	return &bucket{name: name, limit: limit, tokens: float64(limit.Burst), last: now}
+}
+
+// Returns true if the bucket would be full at the time, i.e. the client has
+// been idle for at least as long as it takes the bucket to refill.
+func (b *bucket) full(now time.Time) bool {
+	if b.limit.Rate <= 0 {
+		return true
+	}
+	return b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate >= float64(b.limit.Burst)
+}
+
+// Refill the bucket for the time elapsed then take a token if available.
+func (b *bucket) take(now time.Time) (bool, time.Duration) {
+	if b.limit.Rate <= 0 {
+		return true, 0
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+	if max := float64(b.limit.Burst); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := (1 - b.tokens) / b.limit.Rate
+	return false, time.Duration(wait * float64(time.Second))
+}
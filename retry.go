@@ -0,0 +1,148 @@
+package rtreq
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+
+	pb "github.com/bbengfort/rtreq/msg"
+)
+
+// Default retry policy values used by the CLI.
+const (
+	DefaultMaxAttempts = 3
+	DefaultTimeout     = 5 * time.Second
+	DefaultBaseBackoff = 100 * time.Millisecond
+	DefaultMaxBackoff  = 5 * time.Second
+	DefaultJitter      = 0.2
+)
+
+//===========================================================================
+// Retry Policy
+//===========================================================================
+
+// RetryClass is a bitmask of the classes of errors that can be retried.
+type RetryClass uint8
+
+// Classes of errors that a retry policy may retry.
+const (
+	RetryTimeout     RetryClass = 1 << iota // no reply before the attempt timed out
+	RetryRateLimited                        // the server rate limited the client
+	RetryUnavailable                        // the server replied that it is unavailable
+	RetryExpired                            // the request expired before it was handled
+)
+
+// RetryAll retries every class of retryable error.
+const RetryAll = RetryTimeout | RetryRateLimited | RetryUnavailable | RetryExpired
+
+var retryClassNames = map[string]RetryClass{
+	"timeout":      RetryTimeout,
+	"rate-limited": RetryRateLimited,
+	"unavailable":  RetryUnavailable,
+	"expired":      RetryExpired,
+	"all":          RetryAll,
+}
+
+// ParseRetryClasses parses a comma separated list of retry class names, one
+// of timeout, rate-limited, unavailable, expired or all.
+func ParseRetryClasses(s string) (classes RetryClass, err error) {
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(strings.ToLower(name))
+		if name == "" {
+			continue
+		}
+
+		class, ok := retryClassNames[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown retry class '%s'", name)
+		}
+		classes |= class
+	}
+	return classes, nil
+}
+
+// RetryPolicy specifies how many times a request is attempted, how long to
+// wait for a reply to each attempt, how long to back off between attempts
+// and which errors may be retried. The backoff doubles after every attempt
+// from the base up to the maximum and is randomized by the jitter fraction.
+type RetryPolicy struct {
+	MaxAttempts   int           // maximum number of times a request is sent
+	Timeout       time.Duration // time to wait for a reply to the first attempt
+	TimeoutGrowth float64       // factor the timeout grows by after each attempt
+	BaseBackoff   time.Duration // time to wait before the second attempt
+	MaxBackoff    time.Duration // maximum time to wait between attempts
+	Jitter        float64       // fraction of the backoff that is randomized
+	Retryable     RetryClass    // classes of errors that are retried
+}
+
+// NewRetryPolicy creates a policy with the maximum number of attempts and
+// the timeout of each attempt, using the default backoff and retrying
+// timeouts, rate limits and unavailable servers.
+func NewRetryPolicy(attempts int, timeout time.Duration) *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:   attempts,
+		Timeout:       timeout,
+		TimeoutGrowth: 1.0,
+		BaseBackoff:   DefaultBaseBackoff,
+		MaxBackoff:    DefaultMaxBackoff,
+		Jitter:        DefaultJitter,
+		Retryable:     RetryTimeout | RetryRateLimited | RetryUnavailable,
+	}
+}
+
+// AttemptTimeout returns the time to wait for a reply to the attempt, where
+// the first attempt is 1.
+func (p *RetryPolicy) AttemptTimeout(attempt int) time.Duration {
+	if p.TimeoutGrowth <= 1 || attempt <= 1 {
+		return p.Timeout
+	}
+	return time.Duration(float64(p.Timeout) * math.Pow(p.TimeoutGrowth, float64(attempt-1)))
+}
+
+// Backoff returns the time to wait after the attempt before the next one is
+// sent, where the first attempt is 1.
+func (p *RetryPolicy) Backoff(attempt int) time.Duration {
+	if p.BaseBackoff <= 0 || attempt < 1 {
+		return 0
+	}
+
+	backoff := float64(p.BaseBackoff) * math.Pow(2, float64(attempt-1))
+	if p.MaxBackoff > 0 && backoff > float64(p.MaxBackoff) {
+		backoff = float64(p.MaxBackoff)
+	}
+
+	if p.Jitter > 0 {
+		backoff += backoff * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(backoff)
+}
+
+// Retry returns true if the error is retryable by the policy and there are
+// attempts remaining after the specified attempt.
+func (p *RetryPolicy) Retry(attempt int, err error) bool {
+	if attempt >= p.MaxAttempts {
+		return false
+	}
+	return p.Retryable&retryClass(err) != 0
+}
+
+// Classify an error returned from an attempt to send a request.
+func retryClass(err error) RetryClass {
+	var serr *StatusError
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, ErrRequestTimeout):
+		return RetryTimeout
+	case errors.Is(err, ErrRateLimited):
+		return RetryRateLimited
+	case errors.As(err, &serr) && serr.Code == pb.Status_UNAVAILABLE:
+		return RetryUnavailable
+	case errors.Is(err, ErrDeadlineExceeded):
+		return RetryExpired
+	}
+	return 0
+}
@@ -0,0 +1,221 @@
+package rtreq
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultSampleInterval is how often benchmarks report their progress.
+const DefaultSampleInterval = time.Second
+
+//===========================================================================
+// Time Series Sampling
+//===========================================================================
+
+// NewSampler creates a sampler that reports the requests completed every
+// interval of a benchmark; if the interval is not positive, the
+// DefaultSampleInterval is used.
+func NewSampler(interval time.Duration) *Sampler {
+	if interval <= 0 {
+		interval = DefaultSampleInterval
+	}
+	return &Sampler{interval: interval}
+}
+
+// Sampler records the throughput, latency percentiles, failures and active
+// clients of a benchmark in every interval while it runs, so that stalls and
+// pauses that are hidden by the aggregate results can be seen. Each sample
+// is reported as it is taken and the series is written alongside the
+// results. Requests are sampled in every phase of the benchmark, including
+// the warmup and the cooldown. A nil sampler does not record anything.
+type Sampler struct {
+	sync.Mutex
+	interval time.Duration // time between samples
+	started  time.Time     // when the benchmark started
+	last     time.Time     // when the current interval started
+	messages uint64        // replies received in the current interval
+	failures uint64        // requests that failed in the current interval
+	active   int           // clients that are sending requests
+	peak     int           // most clients sending requests in the current interval
+	hist     *Histogram    // latencies of the current interval
+	samples  []*Sample     // samples of the completed intervals
+	stop     chan struct{} // closed to stop sampling
+	done     chan struct{} // closed when the last sample is taken
+}
+
+// Sample is the requests completed during one interval of a benchmark.
+type Sample struct {
+	Offset   time.Duration // time since the start of the benchmark at the end of the interval
+	Elapsed  time.Duration // length of the interval
+	Messages uint64        // replies received during the interval
+	Failures uint64        // requests that failed during the interval
+	Active   int           // most clients sending requests during the interval
+	Latency  *Histogram    // latencies of the replies received during the interval
+}
+
+// Throughput returns the replies received per second during the interval.
+func (s *Sample) Throughput() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Messages) / s.Elapsed.Seconds()
+}
+
+// Serialize the sample for the results.
+func (s *Sample) Serialize() map[string]interface{} {
+	return map[string]interface{}{
+		"time (nsec)":          s.Offset.Nanoseconds(),
+		"duration (nsec)":      s.Elapsed.Nanoseconds(),
+		"messages":             s.Messages,
+		"failures":             s.Failures,
+		"active clients":       s.Active,
+		"throughput (msg/sec)": s.Throughput(),
+		"latency percentiles":  s.Latency.Serialize(),
+	}
+}
+
+// Record the latency of a request that received a reply.
+func (s *Sampler) Record(latency time.Duration) {
+	if s == nil {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.messages++
+	s.hist.Record(latency)
+}
+
+// Fail records a request that did not receive a reply.
+func (s *Sampler) Fail() {
+	if s == nil {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.failures++
+}
+
+// Join records that a client has started sending requests.
+func (s *Sampler) Join() {
+	if s == nil {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.active++
+	if s.active > s.peak {
+		s.peak = s.active
+	}
+}
+
+// Leave records that a client has stopped sending requests.
+func (s *Sampler) Leave() {
+	if s == nil {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.active--
+}
+
+// Samples returns the samples of the completed intervals.
+func (s *Sampler) Samples() []*Sample {
+	if s == nil {
+		return nil
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	return append([]*Sample(nil), s.samples...)
+}
+
+// Serialize the samples of the completed intervals for the results.
+func (s *Sampler) Serialize() []map[string]interface{} {
+	samples := s.Samples()
+	series := make([]map[string]interface{}, 0, len(samples))
+	for _, sample := range samples {
+		series = append(series, sample.Serialize())
+	}
+	return series
+}
+
+// Start sampling a benchmark, discarding any previous samples.
+func (s *Sampler) start() {
+	if s == nil {
+		return
+	}
+
+	s.Lock()
+	s.started = time.Now()
+	s.last = s.started
+	s.messages = 0
+	s.failures = 0
+	s.active = 0
+	s.peak = 0
+	s.hist = NewHistogram()
+	s.samples = nil
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	s.Unlock()
+
+	go s.run()
+}
+
+// Stop sampling, taking a final sample of the partial interval.
+func (s *Sampler) close() {
+	if s == nil || s.stop == nil {
+		return
+	}
+
+	close(s.stop)
+	<-s.done
+	s.stop = nil
+}
+
+// Take a sample every interval until stopped.
+func (s *Sampler) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			s.sample()
+			return
+		case <-ticker.C:
+			s.sample()
+		}
+	}
+}
+
+// Complete the current interval and report its sample.
+func (s *Sampler) sample() {
+	s.Lock()
+	now := time.Now()
+	sample := &Sample{
+		Offset:   now.Sub(s.started),
+		Elapsed:  now.Sub(s.last),
+		Messages: s.messages,
+		Failures: s.failures,
+		Active:   s.peak,
+		Latency:  s.hist,
+	}
+
+	s.samples = append(s.samples, sample)
+	s.last = now
+	s.messages = 0
+	s.failures = 0
+	s.peak = s.active
+	s.hist = NewHistogram()
+	s.Unlock()
+
+	status(
+		"%s: %d messages at %0.3f msg/sec from %d clients, %d failures - %s",
+		sample.Offset.Round(time.Millisecond), sample.Messages, sample.Throughput(), sample.Active, sample.Failures, sample.Latency,
+	)
+}
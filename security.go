@@ -0,0 +1,264 @@
+package rtreq
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	zmq "github.com/pebbe/zmq4"
+)
+
+// ZAPDomain is the authentication domain used by rtreq servers.
+const ZAPDomain = "rtreq"
+
+// Extensions of the public and secret key files written by keygen.
+const (
+	PublicKeyExt = ".key"
+	SecretKeyExt = ".key_secret"
+)
+
+//===========================================================================
+// Security Configuration
+//===========================================================================
+
+// Security configures encryption and authentication on a transporter.
+// Servers using CURVE must specify their own key pair and optionally a
+// directory of allowed client public keys; clients using CURVE must specify
+// their own key pair and the public key of the server they're connecting to.
+// Without keys, servers may instead authenticate PLAIN usernames and
+// passwords, and any server may restrict the IP addresses of its clients.
+type Security struct {
+	Keys       *KeyPair // the local CURVE key pair of the transporter
+	ServerKey  string   // the public key of the server (clients only)
+	ClientKeys string   // directory of allowed client public keys (servers only)
+	Allow      []string // IP addresses or networks allowed to connect (servers only)
+	Deny       []string // IP addresses or networks denied from connecting (servers only)
+	Passwords  string   // path to the PLAIN credentials file (servers only)
+	Username   string   // PLAIN username (clients only)
+	Password   string   // PLAIN password (clients only)
+}
+
+// NewServerSecurity loads the server key pair from the secret key file and
+// configures the directory of allowed client public keys. If clients is
+// empty, any client with a valid CURVE key pair may connect.
+func NewServerSecurity(secret, clients string) (*Security, error) {
+	keys, err := LoadKeyPair(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	if keys.Secret == "" {
+		return nil, fmt.Errorf("no secret key found in %s", secret)
+	}
+
+	return &Security{Keys: keys, ClientKeys: clients}, nil
+}
+
+// NewClientSecurity loads the client key pair from the secret key file and
+// the public key of the server from the server's public key file.
+func NewClientSecurity(secret, server string) (*Security, error) {
+	keys, err := LoadKeyPair(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	if keys.Secret == "" {
+		return nil, fmt.Errorf("no secret key found in %s", secret)
+	}
+
+	serverKeys, err := LoadKeyPair(server)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Security{Keys: keys, ServerKey: serverKeys.Public}, nil
+}
+
+// Server configures the socket as a CURVE server if keys are specified, a
+// PLAIN server if a passwords file is specified, or a NULL server that is
+// still authenticated by ZAP otherwise. A socket can only use one mechanism,
+// so specifying both keys and passwords is an error. Must be called before
+// binding.
+func (s *Security) Server(sock *zmq.Socket) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+
+	switch {
+	case s.Keys != nil:
+		if err := sock.ServerAuthCurve(ZAPDomain, s.Keys.Secret); err != nil {
+			return WrapError("could not configure CURVE server", err)
+		}
+	case s.Passwords != "":
+		if err := sock.ServerAuthPlain(ZAPDomain); err != nil {
+			return WrapError("could not configure PLAIN server", err)
+		}
+	default:
+		if err := sock.SetZapDomain(ZAPDomain); err != nil {
+			return WrapError("could not set ZAP domain", err)
+		}
+	}
+	return nil
+}
+
+// Client configures the socket as a CURVE client if keys are specified or
+// a PLAIN client if a username is specified. Must be called before the
+// socket is connected.
+func (s *Security) Client(sock *zmq.Socket) error {
+	switch {
+	case s.Keys != nil:
+		if s.ServerKey == "" {
+			return WrapError("could not configure CURVE client", ErrNoServerKey)
+		}
+
+		if err := sock.ClientAuthCurve(s.ServerKey, s.Keys.Public, s.Keys.Secret); err != nil {
+			return WrapError("could not configure CURVE client", err)
+		}
+	case s.Username != "":
+		if err := sock.ClientAuthPlain(s.Username, s.Password); err != nil {
+			return WrapError("could not configure PLAIN client", err)
+		}
+	}
+	return nil
+}
+
+// Check that the server configuration does not specify more than one
+// security mechanism.
+func (s *Security) validate() error {
+	if s.Keys != nil && s.Passwords != "" {
+		return ErrMixedSecurity
+	}
+	return nil
+}
+
+// Determine if the server requires a ZAP handler to authenticate clients.
+func (s *Security) authenticates() bool {
+	return s.ClientKeys != "" || s.Passwords != "" || len(s.Allow) > 0 || len(s.Deny) > 0
+}
+
+//===========================================================================
+// CURVE Key Pairs
+//===========================================================================
+
+// KeyPair holds Z85 encoded CURVE keys. The secret key is empty if the pair
+// was loaded from a public key file.
+type KeyPair struct {
+	Public string // Z85 encoded public key
+	Secret string // Z85 encoded secret key
+}
+
+// GenerateKeyPair creates a new random CURVE key pair.
+func GenerateKeyPair() (*KeyPair, error) {
+	public, secret, err := zmq.NewCurveKeypair()
+	if err != nil {
+		return nil, WrapError("could not generate CURVE key pair", err)
+	}
+	return &KeyPair{Public: public, Secret: secret}, nil
+}
+
+// LoadKeyPair reads a key file in the ZeroMQ certificate format, e.g. one
+// written by KeyPair.Write or by the zcert utilities.
+func LoadKeyPair(path string) (*KeyPair, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, WrapError("could not open key file", err)
+	}
+	defer f.Close()
+
+	keys := new(KeyPair)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		value := strings.Trim(strings.TrimSpace(parts[1]), "\"")
+		switch strings.TrimSpace(parts[0]) {
+		case "public-key":
+			keys.Public = value
+		case "secret-key":
+			keys.Secret = value
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, WrapError("could not read key file", err)
+	}
+
+	if keys.Public == "" {
+		return nil, fmt.Errorf("no public key found in %s", path)
+	}
+
+	return keys, nil
+}
+
+// LoadPublicKeys reads all of the public key files in the specified
+// directory, returning a map of public key to the name of the key file.
+func LoadPublicKeys(dir string) (map[string]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+PublicKeyExt))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]string, len(paths))
+	for _, path := range paths {
+		pair, err := LoadKeyPair(path)
+		if err != nil {
+			return nil, err
+		}
+
+		keys[pair.Public] = strings.TrimSuffix(filepath.Base(path), PublicKeyExt)
+	}
+
+	return keys, nil
+}
+
+// Write the key pair to the directory as a public key file and, if the
+// secret key is available, a secret key file, named by the key owner.
+func (k *KeyPair) Write(dir, name string) error {
+	public := filepath.Join(dir, name+PublicKeyExt)
+	if err := ioutil.WriteFile(public, k.serialize(false), 0644); err != nil {
+		return WrapError("could not write public key", err)
+	}
+
+	if k.Secret != "" {
+		secret := filepath.Join(dir, name+SecretKeyExt)
+		if err := ioutil.WriteFile(secret, k.serialize(true), 0600); err != nil {
+			return WrapError("could not write secret key", err)
+		}
+	}
+
+	return nil
+}
+
+// Serialize the key pair in the ZeroMQ certificate format.
+func (k *KeyPair) serialize(secret bool) []byte {
+	kind := "Public"
+	if secret {
+		kind = "Secret"
+	}
+
+	lines := []string{
+		fmt.Sprintf("#   ****  Generated on %s by rtreq  ****", time.Now().Format(time.RFC3339)),
+		fmt.Sprintf("#   ZeroMQ CURVE %s Certificate", kind),
+		"#   Exchange securely, or use a secure mechanism to verify the contents",
+		"#   of this file after exchange. Store public certificates in your home",
+		"#   directory, in the .curve subdirectory.",
+		"",
+		"metadata",
+		"curve",
+		fmt.Sprintf("    public-key = \"%s\"", k.Public),
+	}
+
+	if secret {
+		lines = append(lines, fmt.Sprintf("    secret-key = \"%s\"", k.Secret))
+	}
+
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
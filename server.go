@@ -1,6 +1,8 @@
 package rtreq
 
 import (
+	"time"
+
 	zmq "github.com/pebbe/zmq4"
 )
 
@@ -33,6 +35,14 @@ func NewServer(addr, name string, sync bool, nWorkers int, context *zmq.Context)
 // Server represents a transporter that can respond to requests from peers.
 type Server interface {
 	Init(addr, name string, context *zmq.Context)
+	SetSecurity(security *Security)
+	SetSigner(signer *Signer)
+	SetSessionTimeout(timeout time.Duration)
+	Sessions() []*Session
+	SetNotifications(addr string)
+	Broadcast(message string) error
+	Notify(identity, message string) error
+	SetPubSub(pubAddr, subAddr string)
 	Run() error
 	Shutdown(path string) error
 }
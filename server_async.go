@@ -4,8 +4,10 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	pb "github.com/bbengfort/rtreq/msg"
+	"github.com/gogo/protobuf/proto"
 	zmq "github.com/pebbe/zmq4"
 	"golang.org/x/sync/errgroup"
 )
@@ -28,6 +30,7 @@ type RouterServer struct {
 	nWorkers int             // number of workers to initialize
 	group    *errgroup.Group // group to manage worker go routines
 	workers  []*Worker       // worker threads to handle requests
+	limiter  *RateLimiter    // per-client rate limits, nil if unlimited
 }
 
 // Run the server and listen for messages
@@ -39,12 +42,38 @@ func (s *RouterServer) Run() (err error) {
 		return WrapError("could not create ROUTER socket", err)
 	}
 
+	// Configure security before binding the socket
+	if err = s.secureServer(); err != nil {
+		return err
+	}
+
+	// Hand connections over to clients that reconnect with the same identity
+	// rather than rejecting them, since clients keep their identity across
+	// resets and the old connection may not have been cleaned up yet.
+	if err = s.sock.SetRouterHandover(true); err != nil {
+		return WrapError("could not set router handover", err)
+	}
+
 	// Bind the client socket to the external address
 	if err = s.sock.Bind(s.addr); err != nil {
 		return WrapError("could not bind '%s'", err, s.addr)
 	}
 	status("bound async server to %s with ROUTER socket\n", s.addr)
 
+	// Start sending notifications to clients if required
+	if s.notifier != nil {
+		if err = s.notifier.start(); err != nil {
+			return err
+		}
+	}
+
+	// Start the publish/subscribe service if required
+	if s.broker != nil {
+		if err = s.broker.start(); err != nil {
+			return err
+		}
+	}
+
 	// Create the socket to talk to workers
 	if s.inproc, err = s.context.NewSocket(zmq.DEALER); err != nil {
 		return WrapError("could not create DEALER socket", err)
@@ -55,19 +84,34 @@ func (s *RouterServer) Run() (err error) {
 		return WrapError("could not bind '%s'", err, IPCAddr)
 	}
 
-	// Create the workers pool
+	// Create the workers pool, sharing an identity tracker to detect clients
+	// with duplicate identities and the client sessions across all workers.
+	s.tracker = NewIdentityTracker()
+	if s.sessions == nil {
+		s.sessions = NewSessionTable(DefaultSessionTimeout)
+	}
 	s.workers = make([]*Worker, 0, s.nWorkers)
 	s.group, _ = errgroup.WithContext(context.Background())
 	for w := 0; w < s.nWorkers; w++ {
 		worker := new(Worker)
 		worker.Init(fmt.Sprintf("%s-%d", s.name, w+1), s.context)
+		worker.SetSigner(s.signer)
+		worker.tracker = s.tracker
+		worker.sessions = s.sessions
 		s.workers = append(s.workers, worker)
 		s.group.Go(worker.Run)
 	}
 	info("initialized %d workers", s.nWorkers)
 
-	// Connect worker threads to clients via a queue proxy
-	if err = zmq.Proxy(s.sock, s.inproc, nil); err != nil {
+	// Connect worker threads to clients via a queue proxy, using the rate
+	// limiting proxy only if required since it must inspect every message.
+	if s.limiter == nil {
+		err = zmq.Proxy(s.sock, s.inproc, nil)
+	} else {
+		err = s.proxy()
+	}
+
+	if err != nil {
 		if !s.stopped {
 			return WrapError("proxy interrupted", err)
 		}
@@ -104,6 +148,12 @@ func (s *RouterServer) SetWorkers(n int) {
 	s.nWorkers = n
 }
 
+// SetRateLimiter specifies per-client rate limits, if nil clients are not
+// limited. Must be called before the server is run.
+func (s *RouterServer) SetRateLimiter(limiter *RateLimiter) {
+	s.limiter = limiter
+}
+
 // Shutdown the server and print the metrics out
 func (s *RouterServer) Shutdown(path string) error {
 	if err := s.Transporter.Shutdown(); err != nil {
@@ -123,6 +173,136 @@ func (s *RouterServer) Shutdown(path string) error {
 	return nil
 }
 
+//===========================================================================
+// Rate Limiting Proxy
+//===========================================================================
+
+// Forward messages between clients and workers like zmq.Proxy, except that
+// messages from clients that have exceeded their rate limit are replied to
+// directly by the router rather than forwarded to the workers.
+func (s *RouterServer) proxy() error {
+	poller := zmq.NewPoller()
+	poller.Add(s.sock, zmq.POLLIN)
+	poller.Add(s.inproc, zmq.POLLIN)
+
+	for {
+		polled, err := poller.Poll(-1)
+		if err != nil {
+			return err
+		}
+
+		for _, item := range polled {
+			switch item.Socket {
+			case s.sock:
+				frames, err := s.sock.RecvMessageBytes(0)
+				if err != nil {
+					return err
+				}
+
+				if s.throttle(frames) {
+					continue
+				}
+
+				if _, err = s.inproc.SendMessage(frames); err != nil {
+					return err
+				}
+			case s.inproc:
+				frames, err := s.inproc.RecvMessageBytes(0)
+				if err != nil {
+					return err
+				}
+
+				if _, err = s.sock.SendMessage(frames); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// Check the client that sent the frames against the rate limiter; if the
+// client has exceeded its limit reply that it has been rate limited along
+// with how long it should wait, and return true so the message is dropped.
+func (s *RouterServer) throttle(frames [][]byte) bool {
+	request, client, wait, limited := s.limited(frames)
+	if !limited {
+		return false
+	}
+
+	s.metrics.Throttle()
+	trace("rate limited %s for %s", client, wait)
+
+	reply := &pb.BasicMessage{
+		Sender:  s.name,
+		Message: wait.String(),
+		Type:    pb.Type_RATE_LIMITED,
+	}
+
+	// Echo the request id so that asynchronous clients can match the reply
+	if request != nil {
+		reply.Id = request.Id
+	}
+
+	data, err := s.marshal(reply)
+	if err != nil {
+		warn("could not marshal rate limited reply: %s", err)
+		return true
+	}
+
+	// Reply with the routing envelope of the original message
+	if _, err := s.sock.SendMessage(frames[:len(frames)-1], data); err != nil {
+		warn("could not send rate limited reply: %s", err)
+	}
+	return true
+}
+
+// Determine if the client that sent the frames has exceeded its rate limit,
+// returning the request if it could be parsed, the identity of the client
+// and how long it should wait. Heartbeats are never limited, since a client
+// whose heartbeats are not answered presumes that the server is dead.
+func (s *RouterServer) limited(frames [][]byte) (request *pb.BasicMessage, client string, wait time.Duration, limited bool) {
+	if len(frames) < 2 {
+		return nil, "", 0, false
+	}
+
+	request = new(pb.BasicMessage)
+	if err := proto.Unmarshal(frames[len(frames)-1], request); err != nil {
+		request = nil
+	}
+
+	if request != nil && request.Type == pb.Type_HEARTBEAT {
+		return request, "", 0, false
+	}
+
+	client, name := clientIdentity(frames[0], request)
+	allowed, wait := s.limiter.Allow(client, name)
+	return request, client, wait, !allowed
+}
+
+// Returns the routing identity and name of the client that sent the request.
+// If the identity was generated by ZMQ (which begins with a zero byte), the
+// sender of the request is used as the identity if it could be parsed. The
+// name is the sender of the request, or if it could not be parsed, the name
+// that prefixes identities created by clients.
+func clientIdentity(routing []byte, request *pb.BasicMessage) (identity, name string) {
+	if request != nil {
+		name = request.Sender
+	}
+
+	identity = string(routing)
+	if len(routing) == 0 || routing[0] == 0 {
+		if name != "" {
+			identity = name
+		}
+		return identity, name
+	}
+
+	if name == "" {
+		name = identityName(identity)
+	}
+	return identity, name
+}
+
 //===========================================================================
 // Message Handling Workers
 //===========================================================================
@@ -169,15 +349,41 @@ func (w *Worker) Run() error {
 			debug("error in %s: %s", w.name, err)
 			break
 		}
-		w.handle(msg)
+
+		// Short-circuit requests the client has already abandoned
+		if w.expire(msg) {
+			continue
+		}
+
+		// Answer heartbeats and administrative requests from the transport
+		if w.admin(msg) {
+			continue
+		}
+
+		start := time.Now()
+		ctx, cancel := requestContext(msg)
+		reply, err := w.handle(ctx, msg)
+		cancel()
+
+		if err = w.reply(msg, reply, err); err != nil {
+			warne(err)
+		}
+		w.sessions.Record(msg, time.Since(start))
 	}
 
 	return w.Close()
 }
 
 // Handle messages received by the worker
-func (w *Worker) handle(message *pb.BasicMessage) {
+func (w *Worker) handle(ctx context.Context, message *pb.BasicMessage) (string, error) {
 	info("received: %s\n", message.String())
-	reply := fmt.Sprintf("reply msg #%d from worker %s", w.nRecv, w.name)
-	w.send(reply)
+	if message.Message == "" {
+		return "", Errorf(pb.Status_INVALID_ARGUMENT, "no message specified")
+	}
+
+	if budget, ok := Budget(ctx); ok {
+		trace("handling request with %s remaining", budget)
+	}
+
+	return fmt.Sprintf("reply msg #%d from worker %s", w.nRecv, w.name), ctx.Err()
 }
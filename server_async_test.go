@@ -0,0 +1,72 @@
+package rtreq
+
+import (
+	"testing"
+
+	pb "github.com/bbengfort/rtreq/msg"
+	"github.com/gogo/protobuf/proto"
+)
+
+// Returns the frames of a message from a client as received by the router.
+func routerFrames(t *testing.T, identity string, message *pb.BasicMessage) [][]byte {
+	data, err := proto.Marshal(message)
+	if err != nil {
+		t.Fatalf("could not marshal message: %s", err)
+	}
+	return [][]byte{[]byte(identity), nil, data}
+}
+
+func TestThrottleExemptsHeartbeats(t *testing.T) {
+	s := &RouterServer{limiter: NewRateLimiter(RateLimit{Rate: 1, Burst: 1})}
+	identity := newIdentity("alice")
+	request := routerFrames(t, identity, &pb.BasicMessage{Sender: "alice", Message: "hello", Id: 42})
+	heartbeat := routerFrames(t, identity+"/heartbeat", &pb.BasicMessage{Sender: "alice", Type: pb.Type_HEARTBEAT, Identity: identity})
+
+	// The first request takes the only token of the bucket
+	if _, _, _, limited := s.limited(request); limited {
+		t.Fatal("first request was rate limited")
+	}
+
+	msg, client, wait, limited := s.limited(request)
+	if !limited {
+		t.Fatal("second request was not rate limited")
+	}
+
+	if msg == nil || msg.Id != 42 {
+		t.Errorf("rate limited request was not parsed: %v", msg)
+	}
+
+	if client != identity {
+		t.Errorf("rate limited client %q, expected %q", client, identity)
+	}
+
+	if wait <= 0 {
+		t.Errorf("rate limited client was not told to wait")
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, _, _, limited := s.limited(heartbeat); limited {
+			t.Fatalf("heartbeat %d was rate limited", i+1)
+		}
+	}
+}
+
+func TestThrottleOverridesByName(t *testing.T) {
+	s := &RouterServer{limiter: NewRateLimiter(RateLimit{Rate: 1, Burst: 1})}
+	s.limiter.Override("alice", RateLimit{Rate: 1000, Burst: 100})
+
+	// Clients that do not set a sender are limited by the name of their identity
+	alice := routerFrames(t, newIdentity("alice"), &pb.BasicMessage{Message: "hello"})
+	bob := routerFrames(t, newIdentity("bob"), &pb.BasicMessage{Sender: "bob", Message: "hello"})
+
+	for i := 0; i < 10; i++ {
+		if _, _, _, limited := s.limited(alice); limited {
+			t.Fatalf("request %d of alice was rate limited", i+1)
+		}
+	}
+
+	s.limited(bob)
+	if _, _, _, limited := s.limited(bob); !limited {
+		t.Fatal("second request of bob was not rate limited")
+	}
+}
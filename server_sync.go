@@ -1,7 +1,9 @@
 package rtreq
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	pb "github.com/bbengfort/rtreq/msg"
 	zmq "github.com/pebbe/zmq4"
@@ -24,19 +26,63 @@ func (s *RepServer) Run() (err error) {
 		return WrapError("could not create REP socket", err)
 	}
 
+	// Configure security before binding the socket
+	if err = s.secureServer(); err != nil {
+		return err
+	}
+
+	// Track client identities to detect duplicates and their sessions
+	s.tracker = NewIdentityTracker()
+	if s.sessions == nil {
+		s.sessions = NewSessionTable(DefaultSessionTimeout)
+	}
+
 	// Bind the socket and run the listener
 	if err := s.sock.Bind(s.addr); err != nil {
 		return WrapError("could not bind '%s'", err, s.addr)
 	}
 	status("bound sync server to %s with REP socket\n", s.addr)
 
+	// Start sending notifications to clients if required
+	if s.notifier != nil {
+		if err = s.notifier.start(); err != nil {
+			return err
+		}
+	}
+
+	// Start the publish/subscribe service if required
+	if s.broker != nil {
+		if err = s.broker.start(); err != nil {
+			return err
+		}
+	}
+
 	for {
 		msg, err := s.recv()
 		if err != nil {
 			warne(err)
 			break
 		}
-		s.handle(msg)
+
+		// Short-circuit requests the client has already abandoned
+		if s.expire(msg) {
+			continue
+		}
+
+		// Answer heartbeats and administrative requests from the transport
+		if s.admin(msg) {
+			continue
+		}
+
+		start := time.Now()
+		ctx, cancel := requestContext(msg)
+		reply, err := s.handle(ctx, msg)
+		cancel()
+
+		if err = s.reply(msg, reply, err); err != nil {
+			warne(err)
+		}
+		s.sessions.Record(msg, time.Since(start))
 	}
 
 	return nil
@@ -60,8 +106,15 @@ func (s *RepServer) Shutdown(path string) error {
 // Message Handling
 //===========================================================================
 
-func (s *RepServer) handle(message *pb.BasicMessage) {
+func (s *RepServer) handle(ctx context.Context, message *pb.BasicMessage) (string, error) {
 	info("received: %s\n", message.String())
-	reply := fmt.Sprintf("reply msg #%d", s.nRecv)
-	s.send(reply)
+	if message.Message == "" {
+		return "", Errorf(pb.Status_INVALID_ARGUMENT, "no message specified")
+	}
+
+	if budget, ok := Budget(ctx); ok {
+		trace("handling request with %s remaining", budget)
+	}
+
+	return fmt.Sprintf("reply msg #%d", s.nRecv), ctx.Err()
 }
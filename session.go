@@ -0,0 +1,219 @@
+package rtreq
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	pb "github.com/bbengfort/rtreq/msg"
+	"github.com/gogo/protobuf/proto"
+)
+
+// DefaultSessionTimeout is how long a client may be idle before the server
+// forgets its session.
+const DefaultSessionTimeout = 5 * time.Minute
+
+//===========================================================================
+// Client Sessions
+//===========================================================================
+
+// Session describes the requests a server has handled for a single client,
+// keyed by the identity of the client (or its name if it has no identity).
+type Session struct {
+	Identity    string        `json:"identity"`     // the identity of the client
+	Sender      string        `json:"sender"`       // the name of the client
+	FirstSeen   time.Time     `json:"first_seen"`   // time of the first request
+	LastSeen    time.Time     `json:"last_seen"`    // time of the most recent request
+	Requests    uint64        `json:"requests"`     // number of requests handled
+	Bytes       uint64        `json:"bytes"`        // total size of the requests
+	MeanService time.Duration `json:"mean_service"` // average time to handle a request
+	Heartbeats  uint64        `json:"heartbeats"`   // number of heartbeats received
+	Dead        bool          `json:"dead"`         // if the client stopped sending heartbeats
+	service     time.Duration // total time spent handling requests
+	heartbeat   time.Time     // time of the most recent heartbeat
+	interval    time.Duration // time between heartbeats of the client
+	liveness    int           // heartbeats the client may miss before it is dead
+}
+
+// Determine if a client that sends heartbeats has missed enough of them that
+// its connection is presumed dead.
+func (s *Session) dead(now time.Time) bool {
+	if s.Heartbeats == 0 {
+		return false
+	}
+	return now.Sub(s.heartbeat) > s.interval*time.Duration(s.liveness)
+}
+
+// SessionTable tracks the sessions of the clients of a server and forgets
+// sessions that have been idle for longer than the timeout. Tables are safe
+// to share between the workers of a server.
+type SessionTable struct {
+	sync.Mutex
+	timeout  time.Duration       // idle time after which a session expires
+	sessions map[string]*Session // active sessions by client identity
+	swept    time.Time           // the last time idle sessions were expired
+}
+
+// NewSessionTable creates an empty session table that expires sessions
+// after they've been idle for the timeout; if the timeout is 0 the
+// DefaultSessionTimeout is used.
+func NewSessionTable(timeout time.Duration) *SessionTable {
+	if timeout <= 0 {
+		timeout = DefaultSessionTimeout
+	}
+
+	return &SessionTable{
+		timeout:  timeout,
+		sessions: make(map[string]*Session),
+		swept:    time.Now(),
+	}
+}
+
+// Record a request that was handled for a client, along with the time it
+// took to handle it.
+func (t *SessionTable) Record(message *pb.BasicMessage, service time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now()
+	t.expire(now)
+
+	session := t.session(message, now)
+	session.Requests++
+	session.Bytes += uint64(proto.Size(message))
+	session.service += service
+}
+
+// Heartbeat records a heartbeat from a client that sends them every interval,
+// keeping its session alive until it misses liveness heartbeats.
+func (t *SessionTable) Heartbeat(message *pb.BasicMessage, interval time.Duration, liveness int) {
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now()
+	t.expire(now)
+
+	session := t.session(message, now)
+	if session.dead(now) {
+		info("session for %s is alive again after %s", session.Identity, now.Sub(session.heartbeat))
+	}
+
+	session.Heartbeats++
+	session.heartbeat = now
+	session.interval = interval
+	session.liveness = liveness
+}
+
+// Sessions returns a snapshot of the active sessions ordered by the time
+// they were first seen.
+func (t *SessionTable) Sessions() []*Session {
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now()
+	t.expire(now)
+	sessions := make([]*Session, 0, len(t.sessions))
+	for _, session := range t.sessions {
+		snapshot := *session
+		snapshot.Dead = session.dead(now)
+		if snapshot.Requests > 0 {
+			snapshot.MeanService = snapshot.service / time.Duration(snapshot.Requests)
+		}
+		sessions = append(sessions, &snapshot)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].FirstSeen.Before(sessions[j].FirstSeen)
+	})
+	return sessions
+}
+
+// Len returns the number of active sessions.
+func (t *SessionTable) Len() int {
+	t.Lock()
+	defer t.Unlock()
+	return len(t.sessions)
+}
+
+// Get or create the session of the client that sent the message, marking it
+// as seen. Must be called with the lock held.
+func (t *SessionTable) session(message *pb.BasicMessage, now time.Time) *Session {
+	key := message.Identity
+	if key == "" {
+		key = message.Sender
+	}
+
+	session, ok := t.sessions[key]
+	if !ok {
+		session = &Session{Identity: key, FirstSeen: now}
+		t.sessions[key] = session
+		debug("started session for %s", key)
+	}
+
+	session.Sender = message.Sender
+	session.LastSeen = now
+	return session
+}
+
+// Forget sessions that have been idle for longer than the timeout, checking
+// at most twice per timeout period. Must be called with the lock held.
+func (t *SessionTable) expire(now time.Time) {
+	if now.Sub(t.swept) < t.timeout/2 {
+		return
+	}
+
+	for key, session := range t.sessions {
+		if now.Sub(session.LastSeen) > t.timeout {
+			delete(t.sessions, key)
+			debug("expired session for %s after %s idle", key, now.Sub(session.LastSeen))
+		}
+	}
+	t.swept = now
+}
+
+//===========================================================================
+// Session Administration
+//===========================================================================
+
+// SetSessionTimeout specifies how long a client may be idle before the
+// server forgets its session. Must be called before the server is run.
+func (t *Transporter) SetSessionTimeout(timeout time.Duration) {
+	t.sessions = NewSessionTable(timeout)
+}
+
+// Sessions returns the active client sessions of the server.
+func (t *Transporter) Sessions() []*Session {
+	if t.sessions == nil {
+		return nil
+	}
+	return t.sessions.Sessions()
+}
+
+// Handles administrative requests and heartbeats that are answered by the
+// transport rather than the message handlers. Returns true if the request
+// was handled.
+func (t *Transporter) admin(message *pb.BasicMessage) bool {
+	switch message.Type {
+	case pb.Type_SESSIONS:
+		t.listSessions(message)
+	case pb.Type_HEARTBEAT:
+		t.heartbeat(message)
+	default:
+		return false
+	}
+	return true
+}
+
+// Replies to a sessions request with the session table as JSON.
+func (t *Transporter) listSessions(message *pb.BasicMessage) {
+	var err error
+	var data []byte
+	if data, err = json.Marshal(t.Sessions()); err != nil {
+		err = Errorf(pb.Status_INTERNAL, "could not serialize sessions: %s", err)
+	}
+
+	if err = t.reply(message, string(data), err); err != nil {
+		warn("could not reply to sessions request: %s", err)
+	}
+}
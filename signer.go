@@ -0,0 +1,151 @@
+package rtreq
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/bbengfort/rtreq/msg"
+	"github.com/gogo/protobuf/proto"
+)
+
+// DefaultSignatureWindow is the maximum clock difference between the time a
+// signed message was sent and the time it was received.
+const DefaultSignatureWindow = 30 * time.Second
+
+//===========================================================================
+// HMAC Message Signatures
+//===========================================================================
+
+// Signer computes and verifies HMAC-SHA256 signatures of messages with a
+// secret shared between clients and servers. The signature covers every
+// field of the message including its timestamp, which must be within the
+// window of the local clock. Signatures seen within the window are cached so
+// that a replayed message is rejected even if its timestamp is still valid.
+type Signer struct {
+	sync.Mutex
+	secret []byte               // shared secret key
+	window time.Duration        // allowed difference between message and local time
+	seen   map[string]time.Time // signatures received within the window
+	pruned time.Time            // last time expired signatures were removed
+}
+
+// NewSigner creates a signer with the shared secret. If window is 0 then the
+// DefaultSignatureWindow is used.
+func NewSigner(secret []byte, window time.Duration) (*Signer, error) {
+	if len(secret) == 0 {
+		return nil, ErrNoSecret
+	}
+
+	if window == 0 {
+		window = DefaultSignatureWindow
+	}
+
+	return &Signer{
+		secret: secret,
+		window: window,
+		seen:   make(map[string]time.Time),
+		pruned: time.Now(),
+	}, nil
+}
+
+// LoadSigner creates a signer with the shared secret read from a file,
+// ignoring any leading or trailing whitespace.
+func LoadSigner(path string, window time.Duration) (*Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, WrapError("could not read secret", err)
+	}
+
+	return NewSigner([]byte(strings.TrimSpace(string(data))), window)
+}
+
+// Clone returns a signer with the same secret and window but its own replay
+// cache, for receivers in the same process that receive copies of the same
+// messages, such as subscribers to the same topic.
+func (s *Signer) Clone() *Signer {
+	return &Signer{
+		secret: s.secret,
+		window: s.window,
+		seen:   make(map[string]time.Time),
+		pruned: time.Now(),
+	}
+}
+
+// Sign the message, setting its timestamp to the current time.
+func (s *Signer) Sign(message *pb.BasicMessage) error {
+	message.Timestamp = time.Now().UnixNano()
+	signature, err := s.digest(message)
+	if err != nil {
+		return err
+	}
+
+	message.Signature = signature
+	return nil
+}
+
+// Verify the signature and timestamp of the message, returning an error if
+// the signature is invalid, the message is outside the window or has been
+// received before.
+func (s *Signer) Verify(message *pb.BasicMessage) error {
+	if len(message.Signature) == 0 {
+		return ErrUnsigned
+	}
+
+	expected, err := s.digest(message)
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal(expected, message.Signature) {
+		return ErrBadSignature
+	}
+
+	// Check the timestamp is within the window of the local clock
+	sent := time.Unix(0, message.Timestamp)
+	if delta := time.Since(sent); delta > s.window || delta < -s.window {
+		return ErrExpiredSignature
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	// Remove signatures that are outside of the window, they will be rejected
+	// by the timestamp check if they're replayed.
+	now := time.Now()
+	if now.Sub(s.pruned) > s.window {
+		for sig, ts := range s.seen {
+			if now.Sub(ts) > s.window {
+				delete(s.seen, sig)
+			}
+		}
+		s.pruned = now
+	}
+
+	key := string(message.Signature)
+	if _, ok := s.seen[key]; ok {
+		return ErrReplayedMessage
+	}
+	s.seen[key] = sent
+
+	return nil
+}
+
+// Compute the HMAC of the serialized message without its signature.
+func (s *Signer) digest(message *pb.BasicMessage) ([]byte, error) {
+	signature := message.Signature
+	message.Signature = nil
+	data, err := proto.Marshal(message)
+	message.Signature = signature
+
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write(data)
+	return mac.Sum(nil), nil
+}
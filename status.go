@@ -0,0 +1,75 @@
+package rtreq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	pb "github.com/bbengfort/rtreq/msg"
+)
+
+//===========================================================================
+// Status Errors
+//===========================================================================
+
+// StatusError is an error with a status code that is carried in the reply
+// envelope. Handlers return status errors to indicate why a request failed,
+// and clients return them from Send when the reply is not OK.
+type StatusError struct {
+	Code   pb.Status // the status code of the reply
+	Detail string    // a description of the error
+}
+
+// Errorf creates a status error with the code and formatted detail.
+func Errorf(code pb.Status, format string, a ...interface{}) *StatusError {
+	return &StatusError{Code: code, Detail: fmt.Sprintf(format, a...)}
+}
+
+// Error returns the status code and detail of the error.
+func (e *StatusError) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("status %s", e.Code)
+	}
+	return fmt.Sprintf("status %s: %s", e.Code, e.Detail)
+}
+
+// Is allows deadline exceeded status errors to match ErrDeadlineExceeded.
+func (e *StatusError) Is(target error) bool {
+	return target == ErrDeadlineExceeded && e.Code == pb.Status_DEADLINE_EXCEEDED
+}
+
+// StatusCode returns the status code a handler error maps to: OK if there is
+// no error, the code of a status error, deadline exceeded if the request
+// context expired, or internal for any other error. Wrapped errors are
+// unwrapped to find the status error or expired context.
+func StatusCode(err error) pb.Status {
+	if err == nil {
+		return pb.Status_OK
+	}
+
+	var serr *StatusError
+	if errors.As(err, &serr) {
+		return serr.Code
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrDeadlineExceeded) {
+		return pb.Status_DEADLINE_EXCEEDED
+	}
+	return pb.Status_INTERNAL
+}
+
+// Converts a reply into an error if it was rejected or rate limited, or its
+// status and error detail into a status error, or nil if the reply is OK.
+func replyError(reply *pb.BasicMessage) error {
+	switch reply.Type {
+	case pb.Type_REJECTED:
+		return WrapError("%s", ErrRejected, reply.Message)
+	case pb.Type_RATE_LIMITED:
+		return WrapError("retry after %s", ErrRateLimited, reply.Message)
+	}
+
+	if reply.Status == pb.Status_OK {
+		return nil
+	}
+	return &StatusError{Code: reply.Status, Detail: reply.Error}
+}
@@ -0,0 +1,278 @@
+package rtreq
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Default parameters of saturation sweeps used by the CLI.
+const (
+	DefaultSweepRate        = 100.0
+	DefaultSweepGrowth      = 2.0
+	DefaultSweepSteps       = 10
+	DefaultSweepRefinements = 3
+)
+
+// Default service level objectives of saturation sweeps used by the CLI.
+const (
+	DefaultSLOPercentile = 99.0
+	DefaultSLOLatency    = 100 * time.Millisecond
+	DefaultSLOErrorRate  = 0.01
+	DefaultSLOThroughput = 0.95
+)
+
+//===========================================================================
+// Service Level Objectives
+//===========================================================================
+
+// SLO is the service level objective a server must meet at an offered load
+// for the load to be sustainable. Each objective that is zero is not checked,
+// so the zero value is met by every load.
+type SLO struct {
+	Percentile float64       // the latency percentile that is checked, e.g. 99
+	Latency    time.Duration // the maximum latency at the percentile
+	ErrorRate  float64       // the maximum fraction of requests that fail or time out
+	Throughput float64       // the minimum fraction of the offered rate that must be achieved
+}
+
+// Check the results of a sweep step against the objectives that are not
+// zero, returning the objectives it violates, if any.
+func (o SLO) Check(step *SweepStep) (violations []string) {
+	if o.Latency > 0 && step.Latency > o.Latency {
+		violations = append(violations, fmt.Sprintf("%s latency %s exceeds %s", percentileName(o.Percentile), step.Latency, o.Latency))
+	}
+
+	if o.ErrorRate > 0 && step.ErrorRate > o.ErrorRate {
+		violations = append(violations, fmt.Sprintf("error rate %0.2f%% exceeds %0.2f%%", step.ErrorRate*100, o.ErrorRate*100))
+	}
+
+	if o.Throughput > 0 && step.Achieved < o.Throughput*step.Rate {
+		violations = append(violations, fmt.Sprintf("achieved %0.1f of %0.1f msg/sec", step.Achieved, step.Rate))
+	}
+	return violations
+}
+
+//===========================================================================
+// Saturation Sweeps
+//===========================================================================
+
+// NewSweep creates a saturation sweep that offers load with the generator,
+// starting at the rate of the generator and multiplying it by growth after
+// every step that meets the objective, for at most maxSteps steps. If the
+// first step violates the objective, the rate is instead divided by growth
+// until a step meets it. The knee is then refined by bisecting between the
+// highest rate that met the objective and the lowest that did not
+// refinements times.
+func NewSweep(generator *LoadGenerator, slo SLO, growth float64, maxSteps, refinements int) (*Sweep, error) {
+	if growth <= 1 {
+		return nil, fmt.Errorf("sweep growth must be greater than 1, not %0.3f", growth)
+	}
+
+	if maxSteps < 1 {
+		return nil, fmt.Errorf("sweep requires at least one step")
+	}
+
+	return &Sweep{
+		generator:   generator,
+		slo:         slo,
+		growth:      growth,
+		maxSteps:    maxSteps,
+		refinements: refinements,
+	}, nil
+}
+
+// Sweep searches for the maximum throughput a server can sustain by offering
+// progressively more open-loop load until the latency, error rate or
+// achieved throughput violates the service level objective. Open-loop load
+// is used so that a saturated server cannot slow down the offered load.
+type Sweep struct {
+	generator   *LoadGenerator // offers the load of each step
+	slo         SLO            // the objective each step is checked against
+	growth      float64        // factor the rate grows by after each step
+	maxSteps    int            // maximum number of growth steps
+	refinements int            // number of bisection steps after a violation
+	steps       []*SweepStep   // the steps of the most recent run
+}
+
+// SweepStep is the result of offering load at a single rate.
+type SweepStep struct {
+	Rate       float64       // the offered rate in requests per second
+	Achieved   float64       // the rate of replies in requests per second
+	Latency    time.Duration // the latency at the objective percentile
+	ErrorRate  float64       // the fraction of requests that failed or timed out
+	Violations []string      // the objectives that were violated, if any
+}
+
+// Sustainable returns true if the step met the objective.
+func (s *SweepStep) Sustainable() bool {
+	return len(s.Violations) == 0
+}
+
+// Serialize the step for the results.
+func (s *SweepStep) Serialize() map[string]interface{} {
+	return map[string]interface{}{
+		"offered rate (msg/sec)":  s.Rate,
+		"achieved rate (msg/sec)": s.Achieved,
+		"latency (nsec)":          s.Latency.Nanoseconds(),
+		"error rate":              s.ErrorRate,
+		"sustainable":             s.Sustainable(),
+		"violations":              s.Violations,
+	}
+}
+
+// Run the sweep, offering load at each rate for the duration with the phases
+// and timeout of the generator, and appending the results of each step to
+// the results path as it completes.
+func (s *Sweep) Run(duration time.Duration, phases Phases, timeout time.Duration, sampler *Sampler, results string) (err error) {
+	s.steps = nil
+	var good, bad float64
+
+	// Grow the rate until the objective is violated, or if the first rate
+	// violates it, shrink the rate until the objective is met
+	rate := s.generator.rate
+	for i := 0; i < s.maxSteps; i++ {
+		var step *SweepStep
+		if step, err = s.step(rate, duration, phases, timeout, sampler, results); err != nil {
+			return err
+		}
+
+		if step.Sustainable() {
+			good = rate
+			if bad > 0 {
+				break
+			}
+			rate *= s.growth
+		} else {
+			bad = rate
+			if good > 0 {
+				break
+			}
+			rate /= s.growth
+		}
+	}
+
+	if bad == 0 {
+		status("server sustained %0.1f msg/sec without violating the objective", good)
+		return nil
+	}
+
+	if good == 0 {
+		status("server did not meet the objective at %0.1f msg/sec or more", bad)
+		return nil
+	}
+
+	// Bisect between the highest sustainable rate and the lowest that was not
+	for i := 0; i < s.refinements; i++ {
+		rate = (good + bad) / 2
+		var step *SweepStep
+		if step, err = s.step(rate, duration, phases, timeout, sampler, results); err != nil {
+			return err
+		}
+
+		if step.Sustainable() {
+			good = rate
+		} else {
+			bad = rate
+		}
+	}
+	return nil
+}
+
+// Steps returns the steps of the most recent run in the order they ran.
+func (s *Sweep) Steps() []*SweepStep {
+	return s.steps
+}
+
+// MaxSustainable returns the step with the highest achieved throughput that
+// met the objective, nil if no step did.
+func (s *Sweep) MaxSustainable() *SweepStep {
+	var best *SweepStep
+	for _, step := range s.steps {
+		if step.Sustainable() && (best == nil || step.Achieved > best.Achieved) {
+			best = step
+		}
+	}
+	return best
+}
+
+// Results appends the steps of the most recent run and the maximum
+// sustainable throughput to the path.
+func (s *Sweep) Results(path string, data map[string]interface{}) error {
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+
+	steps := make([]map[string]interface{}, 0, len(s.steps))
+	for _, step := range s.steps {
+		steps = append(steps, step.Serialize())
+	}
+
+	data["mode"] = "sweep"
+	data["name"] = s.generator.client.identity
+	data["slo percentile"] = s.slo.Percentile
+	data["slo latency (nsec)"] = s.slo.Latency.Nanoseconds()
+	data["slo error rate"] = s.slo.ErrorRate
+	data["slo throughput"] = s.slo.Throughput
+	data["steps"] = steps
+
+	best := s.MaxSustainable()
+	if best == nil {
+		data["max sustainable throughput (msg/sec)"] = 0.0
+		status("no offered rate met the objective, the lowest was %0.1f msg/sec", s.lowest())
+	} else {
+		data["max sustainable throughput (msg/sec)"] = best.Achieved
+		data["max sustainable rate (msg/sec)"] = best.Rate
+		status(
+			"max sustainable throughput %0.3f msg/sec offered %0.1f msg/sec with %s latency %s in %d steps",
+			best.Achieved, best.Rate, percentileName(s.slo.Percentile), best.Latency, len(s.steps),
+		)
+	}
+
+	debug("writing results to %s", path)
+	return appendJSON(path, data)
+}
+
+// Returns the lowest rate offered by the most recent run.
+func (s *Sweep) lowest() (rate float64) {
+	for _, step := range s.steps {
+		if rate == 0 || step.Rate < rate {
+			rate = step.Rate
+		}
+	}
+	return rate
+}
+
+// Offer load at the rate, check it against the objective and record it.
+func (s *Sweep) step(rate float64, duration time.Duration, phases Phases, timeout time.Duration, sampler *Sampler, results string) (*SweepStep, error) {
+	g := s.generator
+	initial := g.rate
+	g.rate = rate
+	defer func() { g.rate = initial }()
+
+	if err := g.Run(duration, phases, timeout, sampler); err != nil {
+		return nil, err
+	}
+
+	g.Lock()
+	step := &SweepStep{Rate: rate, Latency: g.latencyH.Percentile(s.slo.Percentile)}
+	if g.elapsed > 0 {
+		step.Achieved = float64(g.completed) / g.elapsed.Seconds()
+	}
+	if g.scheduled > 0 {
+		step.ErrorRate = float64(g.failed+g.timeouts) / float64(g.scheduled)
+	}
+	g.Unlock()
+
+	step.Violations = s.slo.Check(step)
+	s.steps = append(s.steps, step)
+
+	if step.Sustainable() {
+		status("step %d at %0.1f msg/sec is sustainable", len(s.steps), rate)
+	} else {
+		status("step %d at %0.1f msg/sec is not sustainable: %s", len(s.steps), rate, strings.Join(step.Violations, ", "))
+	}
+
+	data := map[string]interface{}{"sweep step": len(s.steps), "sustainable": step.Sustainable()}
+	return step, g.Results(results, data)
+}
@@ -0,0 +1,149 @@
+package rtreq
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//===========================================================================
+// Think Time
+//===========================================================================
+
+// ThinkDistribution is the distribution think times are drawn from.
+type ThinkDistribution uint8
+
+// Think time distributions: constant think times are always the mean,
+// exponential think times have the mean, and uniform think times are
+// between a minimum and maximum.
+const (
+	ConstantThink ThinkDistribution = iota
+	ExponentialThink
+	UniformThink
+)
+
+var thinkDistributionStrings = [...]string{"constant", "exponential", "uniform"}
+
+// String returns a human readable representation of the distribution.
+func (d ThinkDistribution) String() string {
+	return thinkDistributionStrings[d]
+}
+
+// ThinkTime is how long a client pauses after receiving a reply before it
+// sends its next request, like a user reading a page. Think time is not
+// included in the latency of requests. The zero value does not pause.
+type ThinkTime struct {
+	Distribution ThinkDistribution // the distribution think times are drawn from
+	Mean         time.Duration     // the constant or mean think time
+	Min          time.Duration     // the shortest uniform think time
+	Max          time.Duration     // the longest uniform think time
+}
+
+// ParseThinkTime parses a think time, which is either a constant duration,
+// e.g. 10ms, or one of constant:MEAN, exponential:MEAN or uniform:MIN:MAX.
+func ParseThinkTime(s string) (think ThinkTime, err error) {
+	parts := strings.Split(s, ":")
+	if len(parts) == 1 {
+		parts = []string{ConstantThink.String(), parts[0]}
+	}
+
+	durations := make([]time.Duration, 0, len(parts)-1)
+	for _, part := range parts[1:] {
+		var d time.Duration
+		if d, err = time.ParseDuration(part); err != nil || d < 0 {
+			return think, fmt.Errorf("invalid think time '%s'", s)
+		}
+		durations = append(durations, d)
+	}
+
+	switch {
+	case parts[0] == "constant" && len(durations) == 1:
+		return ThinkTime{Distribution: ConstantThink, Mean: durations[0]}, nil
+	case parts[0] == "exponential" && len(durations) == 1:
+		return ThinkTime{Distribution: ExponentialThink, Mean: durations[0]}, nil
+	case parts[0] == "uniform" && len(durations) == 2:
+		if durations[0] > durations[1] {
+			return think, fmt.Errorf("invalid think time '%s': minimum is greater than maximum", s)
+		}
+		return ThinkTime{Distribution: UniformThink, Min: durations[0], Max: durations[1]}, nil
+	}
+	return think, fmt.Errorf("invalid think time '%s'", s)
+}
+
+// String returns the think time in the format it is parsed from.
+func (t ThinkTime) String() string {
+	if t.Distribution == UniformThink {
+		return fmt.Sprintf("%s:%s:%s", t.Distribution, t.Min, t.Max)
+	}
+	return fmt.Sprintf("%s:%s", t.Distribution, t.Mean)
+}
+
+// Draw a think time from the distribution.
+func (t ThinkTime) sample() time.Duration {
+	switch t.Distribution {
+	case ExponentialThink:
+		return time.Duration(rand.ExpFloat64() * float64(t.Mean))
+	case UniformThink:
+		return t.Min + time.Duration(rand.Int63n(int64(t.Max-t.Min)+1))
+	default:
+		return t.Mean
+	}
+}
+
+//===========================================================================
+// Ramp Profiles
+//===========================================================================
+
+// Ramp starts the clients of a benchmark gradually rather than all at once.
+// Clients start evenly over the duration of the ramp, or if steps are
+// specified, in that many equal groups spaced evenly over the duration with
+// the first group starting immediately. The zero value starts every client
+// at the beginning of the benchmark.
+type Ramp struct {
+	Duration time.Duration // time over which the clients are started
+	Steps    int           // number of groups to start clients in, 0 for one at a time
+}
+
+// ParseRamp parses a ramp profile, which is a duration, e.g. 10s, to start
+// clients one at a time, or DURATION:STEPS to start them in groups.
+func ParseRamp(s string) (ramp Ramp, err error) {
+	parts := strings.Split(s, ":")
+	if len(parts) > 2 {
+		return ramp, fmt.Errorf("invalid ramp '%s', expected DURATION[:STEPS]", s)
+	}
+
+	if ramp.Duration, err = time.ParseDuration(parts[0]); err != nil || ramp.Duration < 0 {
+		return ramp, fmt.Errorf("invalid ramp duration '%s'", parts[0])
+	}
+
+	if len(parts) == 2 {
+		if ramp.Steps, err = strconv.Atoi(parts[1]); err != nil || ramp.Steps < 1 {
+			return ramp, fmt.Errorf("invalid ramp steps '%s'", parts[1])
+		}
+	}
+	return ramp, nil
+}
+
+// String returns the ramp in the format it is parsed from.
+func (r Ramp) String() string {
+	if r.Steps > 0 {
+		return fmt.Sprintf("%s:%d", r.Duration, r.Steps)
+	}
+	return r.Duration.String()
+}
+
+// Delay returns how long after the start of the benchmark the ith of n
+// clients starts, where the first client is 0.
+func (r Ramp) Delay(i, n int) time.Duration {
+	if r.Duration <= 0 || n <= 1 {
+		return 0
+	}
+
+	if r.Steps > 0 {
+		step := i * r.Steps / n
+		return r.Duration * time.Duration(step) / time.Duration(r.Steps)
+	}
+	return r.Duration * time.Duration(i) / time.Duration(n)
+}
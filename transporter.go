@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"time"
 
 	pb "github.com/bbengfort/rtreq/msg"
 	"github.com/gogo/protobuf/proto"
@@ -22,15 +23,23 @@ import (
 // defined as protocol buffers. They can wrap any type of ZMQ object and its
 // up to the primary classes to instantiate the socket correctly.
 type Transporter struct {
-	name    string       // host information for the specified transporter
-	addr    string       // address information of the connection
-	context *zmq.Context // the zmq context to manage
-	sock    *zmq.Socket  // the zmq socket to send and receive messages
-	nSent   uint64       // number of messages sent
-	nRecv   uint64       // number of messages received
-	nBytes  uint64       // number of bytes sent
-	metrics *Metrics     // client access metrics
-	stopped bool         // if the server is shutdown or not
+	name     string           // host information for the specified transporter
+	addr     string           // address information of the connection
+	context  *zmq.Context     // the zmq context to manage
+	sock     *zmq.Socket      // the zmq socket to send and receive messages
+	nSent    uint64           // number of messages sent
+	nRecv    uint64           // number of messages received
+	nBytes   uint64           // number of bytes sent
+	metrics  *Metrics         // client access metrics
+	security *Security        // CURVE security configuration, nil if plaintext
+	signer   *Signer          // HMAC message signer, nil if messages aren't signed
+	identity string           // the identity of a client, stable across resets
+	conn     uint64           // random id of the current connection of a client
+	tracker  *IdentityTracker // detects duplicate client identities on servers
+	sessions *SessionTable    // sessions of the clients of a server
+	notifier *Notifier        // pushes notifications to clients of a server
+	broker   *Broker          // forwards messages from publishers to subscribers
+	stopped  bool             // if the server is shutdown or not
 }
 
 // Init the transporter with the specified host and any other internal data.
@@ -47,8 +56,90 @@ func (t *Transporter) Init(addr, name string, context *zmq.Context) {
 	t.name = name
 }
 
+// SetSecurity enables CURVE encryption and authentication on the socket the
+// next time it is bound or connected. Pass nil to use plaintext connections.
+func (t *Transporter) SetSecurity(security *Security) {
+	t.security = security
+}
+
+// Identity returns the identity the client presents to the server.
+func (t *Transporter) Identity() string {
+	return t.identity
+}
+
+// SetIdentity specifies the identity the client presents to the server the
+// next time it connects; it must be unique among all clients of the server.
+func (t *Transporter) SetIdentity(identity string) {
+	t.identity = identity
+}
+
+// SetSigner enables HMAC signatures on all sent messages and requires valid
+// signatures on all received messages. Pass nil to disable signatures.
+func (t *Transporter) SetSigner(signer *Signer) {
+	t.signer = signer
+}
+
+// Configure security on a server socket before it is bound, starting a ZAP
+// handler in the context if the server authenticates its clients.
+func (t *Transporter) secureServer() error {
+	if t.security == nil {
+		return nil
+	}
+
+	if err := t.security.validate(); err != nil {
+		return err
+	}
+
+	if t.security.authenticates() {
+		auth, err := NewAuthenticator(t.context)
+		if err != nil {
+			return err
+		}
+		auth.metrics = t.metrics
+
+		if t.security.ClientKeys != "" {
+			keys, err := LoadPublicKeys(t.security.ClientKeys)
+			if err != nil {
+				return WrapError("could not load client keys", err)
+			}
+			auth.AllowCurve(keys)
+			info("authorizing %d client keys from %s", len(keys), t.security.ClientKeys)
+		}
+
+		if t.security.Passwords != "" {
+			passwords, err := LoadPasswords(t.security.Passwords)
+			if err != nil {
+				return err
+			}
+			auth.AllowPlain(passwords)
+			info("authorizing %d users from %s", len(passwords), t.security.Passwords)
+		}
+
+		if err := auth.Allow(t.security.Allow...); err != nil {
+			return err
+		}
+
+		if err := auth.Deny(t.security.Deny...); err != nil {
+			return err
+		}
+
+		go func() {
+			if err := auth.Run(); err != nil {
+				warn("authentication handler stopped: %s", err)
+			}
+		}()
+	}
+
+	return t.security.Server(t.sock)
+}
+
 // Close the socket and clean up the connections.
 func (t *Transporter) Close() error {
+	// Nothing to close if the socket could not be created
+	if t.sock == nil {
+		return nil
+	}
+
 	// Set linger to 0 so the connection closes immediately
 	if err := t.sock.SetLinger(0); err != nil {
 		return err
@@ -58,9 +149,21 @@ func (t *Transporter) Close() error {
 	return t.sock.Close()
 }
 
-// Shutdown the ZMQ context permanently (should only be called once).
+// Shutdown the ZMQ context permanently (should only be called once). If the
+// server sends notifications, subscribed clients are warned first.
 func (t *Transporter) Shutdown() error {
 	t.stopped = true
+	if t.notifier != nil && t.notifier.stop != nil {
+		if err := t.Broadcast("server is shutting down"); err != nil {
+			warn("could not send shutdown notification: %s", err)
+		}
+
+		if err := t.notifier.close(); err != nil {
+			warn("could not close notifier: %s", err)
+		}
+		t.notifier = nil
+	}
+
 	if err := t.context.Term(); err != nil {
 		return err
 	}
@@ -78,48 +181,114 @@ func (t *Transporter) Shutdown() error {
 
 // Reads a zmq message from the socket and composes it into a protobuff
 // message for handling downstream. This method blocks until a message is
-// received.
+// received. If the transporter signs messages, messages with invalid
+// signatures are rejected with a reply and the next message is awaited.
 func (t *Transporter) recv() (*pb.BasicMessage, error) {
 	// Break if the socket hasn't been created
 	if t.sock == nil {
 		return nil, errors.New("socket is not initialized")
 	}
 
-	// Read the data off the wire
-	bytes, err := t.sock.RecvBytes(0)
-	if err != nil {
-		return nil, err
-	}
+	for {
+		// Read the data off the wire
+		bytes, err := t.sock.RecvBytes(0)
+		if err != nil {
+			return nil, err
+		}
 
-	// Parse the protocol buffers message
-	message := new(pb.BasicMessage)
-	if err := proto.Unmarshal(bytes, message); err != nil {
-		return nil, err
-	}
+		// Parse the protocol buffers message
+		message := new(pb.BasicMessage)
+		if err := proto.Unmarshal(bytes, message); err != nil {
+			return nil, err
+		}
+
+		// Verify the signature and reject the message if it's invalid
+		if t.signer != nil {
+			if err := t.signer.Verify(message); err != nil {
+				warn("rejecting message from %s: %s", message.Sender, err)
+				if err := t.reject(message, err.Error()); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+
+		// Heartbeats are sent on a companion socket and are not accesses
+		if message.Type == pb.Type_HEARTBEAT {
+			return message, nil
+		}
+
+		// Detect multiple live connections with the same client identity
+		if t.tracker != nil && message.Identity != "" {
+			if t.tracker.Observe(message.Identity, message.Connection) {
+				t.metrics.Duplicate()
+			}
+		}
 
-	// Increment the number of messages received
-	t.nRecv++
-	t.metrics.Increment(message.Sender)
+		// Increment the number of messages received
+		t.nRecv++
+		t.metrics.Increment(message.Sender)
 
-	// Return the message
-	return message, nil
+		// Return the message
+		return message, nil
+	}
 }
 
 // Composes a message into protocol buffers and puts it on the socket.
 // Does not wait for the receiver, just fires off the reply.
 func (t *Transporter) send(message string) error {
-	if t.sock == nil {
-		return errors.New("socket is not initialized")
+	return t.transmit(&pb.BasicMessage{
+		Sender:  t.name,
+		Message: message,
+	})
+}
+
+// Replies to a request with the result of handling it. If the handler
+// returned an error, the reply carries its status code and detail.
+func (t *Transporter) reply(request *pb.BasicMessage, message string, err error) error {
+	msg := &pb.BasicMessage{Sender: t.name, Message: message, Id: request.Id}
+	if err != nil {
+		msg.Status = StatusCode(err)
+		if serr, ok := err.(*StatusError); ok {
+			msg.Error = serr.Detail
+		} else {
+			msg.Error = err.Error()
+		}
 	}
+	return t.transmit(msg)
+}
+
+// Composes a request that the receiver should abandon after the deadline and
+// puts it on the socket.
+func (t *Transporter) request(message string, deadline time.Time) error {
+	return t.transmit(&pb.BasicMessage{
+		Sender:     t.name,
+		Message:    message,
+		Deadline:   deadline.UnixNano(),
+		Identity:   t.identity,
+		Connection: t.conn,
+	})
+}
 
-	// Compose the protobuf message
-	msg := &pb.BasicMessage{
+// Replies to a message that could not be handled with the reason why.
+func (t *Transporter) reject(request *pb.BasicMessage, reason string) error {
+	return t.transmit(&pb.BasicMessage{
 		Sender:  t.name,
-		Message: message,
+		Message: reason,
+		Type:    pb.Type_REJECTED,
+		Id:      request.Id,
+	})
+}
+
+// Serializes the protobuf message and puts it on the socket, updating the
+// send metrics.
+func (t *Transporter) transmit(msg *pb.BasicMessage) error {
+	if t.sock == nil {
+		return errors.New("socket is not initialized")
 	}
 
 	// Serialize the message
-	data, err := proto.Marshal(msg)
+	data, err := t.marshal(msg)
 	if err != nil {
 		return err
 	}
@@ -137,3 +306,17 @@ func (t *Transporter) send(message string) error {
 
 	return nil
 }
+
+// Signs the protobuf message, or timestamps it if signatures aren't required,
+// then serializes it to send on the wire.
+func (t *Transporter) marshal(msg *pb.BasicMessage) ([]byte, error) {
+	if t.signer != nil {
+		if err := t.signer.Sign(msg); err != nil {
+			return nil, err
+		}
+	} else {
+		msg.Timestamp = time.Now().UnixNano()
+	}
+
+	return proto.Marshal(msg)
+}
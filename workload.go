@@ -0,0 +1,336 @@
+package rtreq
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxPayloadSize is the largest payload a workload sends; sizes drawn from
+// unbounded distributions are capped to it.
+const MaxPayloadSize = 1 << 20
+
+//===========================================================================
+// Payload Sizes
+//===========================================================================
+
+// SizeDistribution is the distribution payload sizes are drawn from.
+type SizeDistribution uint8
+
+// Size distributions: fixed sizes are always the same, uniform sizes are
+// between a minimum and maximum, normal sizes have a mean and standard
+// deviation, and exponential sizes have a mean.
+const (
+	FixedSize SizeDistribution = iota
+	UniformSize
+	NormalSize
+	ExponentialSize
+)
+
+var sizeDistributionStrings = [...]string{"fixed", "uniform", "normal", "exponential"}
+
+// String returns a human readable representation of the distribution.
+func (d SizeDistribution) String() string {
+	return sizeDistributionStrings[d]
+}
+
+// PayloadSize describes the size in bytes of the messages of a request
+// class. Sizes smaller than the header that numbers and timestamps each
+// message are sent as just the header.
+type PayloadSize struct {
+	Distribution SizeDistribution // the distribution sizes are drawn from
+	Size         int              // the fixed size, or the mean of normal and exponential sizes
+	Min          int              // the smallest uniform size
+	Max          int              // the largest uniform size
+	StdDev       int              // the standard deviation of normal sizes
+}
+
+// ParsePayloadSize parses a payload size in bytes, which is either a fixed
+// size, e.g. 512, or one of fixed:SIZE, uniform:MIN:MAX, normal:MEAN:STDDEV
+// or exponential:MEAN.
+func ParsePayloadSize(s string) (size PayloadSize, err error) {
+	parts := strings.Split(s, ":")
+	if len(parts) == 1 {
+		parts = []string{FixedSize.String(), parts[0]}
+	}
+
+	values := make([]int, 0, len(parts)-1)
+	for _, part := range parts[1:] {
+		var value int
+		if value, err = strconv.Atoi(part); err != nil || value < 0 {
+			return size, fmt.Errorf("invalid payload size '%s'", s)
+		}
+		values = append(values, value)
+	}
+
+	nargs := map[string]int{"fixed": 1, "uniform": 2, "normal": 2, "exponential": 1}
+	if n, ok := nargs[parts[0]]; !ok || n != len(values) {
+		return size, fmt.Errorf("invalid payload size '%s'", s)
+	}
+
+	switch parts[0] {
+	case "fixed":
+		size = PayloadSize{Distribution: FixedSize, Size: values[0]}
+	case "uniform":
+		if values[0] > values[1] {
+			return size, fmt.Errorf("invalid payload size '%s': minimum is greater than maximum", s)
+		}
+		size = PayloadSize{Distribution: UniformSize, Min: values[0], Max: values[1]}
+	case "normal":
+		size = PayloadSize{Distribution: NormalSize, Size: values[0], StdDev: values[1]}
+	case "exponential":
+		size = PayloadSize{Distribution: ExponentialSize, Size: values[0]}
+	}
+
+	if size.limit() > MaxPayloadSize {
+		return size, fmt.Errorf("invalid payload size '%s': larger than %d bytes", s, MaxPayloadSize)
+	}
+	return size, nil
+}
+
+// String returns the payload size in the format it is parsed from.
+func (p PayloadSize) String() string {
+	switch p.Distribution {
+	case UniformSize:
+		return fmt.Sprintf("%s:%d:%d", p.Distribution, p.Min, p.Max)
+	case NormalSize:
+		return fmt.Sprintf("%s:%d:%d", p.Distribution, p.Size, p.StdDev)
+	default:
+		return fmt.Sprintf("%s:%d", p.Distribution, p.Size)
+	}
+}
+
+// Draw a payload size from the distribution.
+func (p PayloadSize) sample(r *rand.Rand) int {
+	var size float64
+	switch p.Distribution {
+	case FixedSize:
+		return p.Size
+	case UniformSize:
+		return p.Min + r.Intn(p.Max-p.Min+1)
+	case NormalSize:
+		size = r.NormFloat64()*float64(p.StdDev) + float64(p.Size)
+	case ExponentialSize:
+		size = r.ExpFloat64() * float64(p.Size)
+	}
+	return int(math.Max(0, math.Min(math.Round(size), MaxPayloadSize)))
+}
+
+// Returns the largest size that can be drawn from the distribution.
+func (p PayloadSize) limit() int {
+	switch p.Distribution {
+	case UniformSize:
+		return p.Max
+	case NormalSize, ExponentialSize:
+		if p.Size > MaxPayloadSize {
+			return p.Size
+		}
+		return MaxPayloadSize
+	default:
+		return p.Size
+	}
+}
+
+//===========================================================================
+// Workload Mix
+//===========================================================================
+
+// RequestClass is one kind of request in a workload, sent in proportion to
+// its weight with payloads of its size.
+type RequestClass struct {
+	Name     string      // the name of the class in the results
+	Weight   int         // the relative frequency of the class
+	Size     PayloadSize // the size of the payloads of the class
+	requests uint64      // measured requests of the class that received replies
+	bytes    uint64      // payload bytes of the measured requests
+	hist     *Histogram  // latencies of the measured requests
+}
+
+// NewWorkload creates a workload that sends a weighted mix of the request
+// classes. Payloads are generated deterministically from the seed, so that
+// benchmarks with the same seed send the same requests.
+func NewWorkload(seed int64, classes ...*RequestClass) (*Workload, error) {
+	if len(classes) == 0 {
+		return nil, fmt.Errorf("workload requires at least one request class")
+	}
+
+	w := &Workload{seed: seed, classes: classes}
+	limit := 0
+	for _, class := range classes {
+		if class.Weight < 1 {
+			return nil, fmt.Errorf("weight of request class %q must be positive", class.Name)
+		}
+
+		w.total += class.Weight
+		if size := class.Size.limit(); size > limit {
+			limit = size
+		}
+	}
+
+	// Pad payloads from a single random string, so that padding does not
+	// have to be generated for every request.
+	padding := make([]byte, limit)
+	r := rand.New(rand.NewSource(seed))
+	for i := range padding {
+		padding[i] = byte('a' + r.Intn(26))
+	}
+	w.padding = string(padding)
+
+	w.reset()
+	return w, nil
+}
+
+// ParseWorkload parses a comma separated mix of request classes, each of
+// which is NAME:WEIGHT:SIZE where the size is parsed by ParsePayloadSize,
+// e.g. "get:80:64,put:20:uniform:1024:8192".
+func ParseWorkload(s string, seed int64) (*Workload, error) {
+	var classes []*RequestClass
+	for _, spec := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(spec), ":", 3)
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid request class '%s', expected NAME:WEIGHT:SIZE", spec)
+		}
+
+		weight, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid weight of request class '%s'", spec)
+		}
+
+		size, err := ParsePayloadSize(parts[2])
+		if err != nil {
+			return nil, err
+		}
+
+		classes = append(classes, &RequestClass{Name: parts[0], Weight: weight, Size: size})
+	}
+	return NewWorkload(seed, classes...)
+}
+
+// Workload is the mix of requests sent by benchmarks along with the
+// measured results of each class. Each client sending the workload draws
+// requests from its own deterministic stream.
+type Workload struct {
+	sync.Mutex
+	seed    int64           // the seed the streams of requests are derived from
+	classes []*RequestClass // the request classes of the mix
+	total   int             // the sum of the weights of the classes
+	padding string          // random text that payloads are padded with
+}
+
+// Serialize the classes of the workload and their measured results.
+func (w *Workload) Serialize() []map[string]interface{} {
+	w.Lock()
+	defer w.Unlock()
+
+	classes := make([]map[string]interface{}, 0, len(w.classes))
+	for _, class := range w.classes {
+		classes = append(classes, map[string]interface{}{
+			"name":                class.Name,
+			"weight":              class.Weight,
+			"payload size":        class.Size.String(),
+			"messages":            class.requests,
+			"bytes":               class.bytes,
+			"latency percentiles": class.hist.Serialize(),
+		})
+	}
+	return classes
+}
+
+// Returns the stream of requests of the nth client sending the workload,
+// which is nil if the workload is nil so that default requests are sent.
+func (w *Workload) stream(n int) *requestStream {
+	if w == nil {
+		return nil
+	}
+	return &requestStream{workload: w, n: n, rand: rand.New(rand.NewSource(w.seed + int64(n)))}
+}
+
+// Reset the measured results of the classes.
+func (w *Workload) reset() {
+	if w == nil {
+		return
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	for _, class := range w.classes {
+		class.requests = 0
+		class.bytes = 0
+		class.hist = NewHistogram()
+	}
+}
+
+// Record a measured request of the class that received a reply.
+func (w *Workload) record(class *RequestClass, size int, latency time.Duration) {
+	if w == nil || class == nil {
+		return
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	class.requests++
+	class.bytes += uint64(size)
+	class.hist.Record(latency)
+}
+
+// The requests of a single client sending a workload.
+type requestStream struct {
+	workload *Workload  // the workload the requests are drawn from
+	n        int        // the number of the client sending the stream
+	rand     *rand.Rand // the deterministic source of the stream
+}
+
+// Restart the stream from its seed and reset the results of the workload.
+func (s *requestStream) reset() {
+	if s == nil {
+		return
+	}
+	s.rand = rand.New(rand.NewSource(s.workload.seed + int64(s.n)))
+	s.workload.reset()
+}
+
+// Record a measured request of the class that received a reply.
+func (s *requestStream) record(class *RequestClass, size int, latency time.Duration) {
+	if s == nil {
+		return
+	}
+	s.workload.record(class, size, latency)
+}
+
+// Add the workload and its measured results to the results, if any.
+func (s *requestStream) serialize(data map[string]interface{}) {
+	if s == nil {
+		return
+	}
+	data["workload"] = s.workload.Serialize()
+}
+
+// Returns the class and message of the next request, numbered seq. A nil
+// stream returns the default message with no class.
+func (s *requestStream) next(seq uint64) (*RequestClass, string) {
+	if s == nil {
+		return nil, fmt.Sprintf("msg %d at %s", seq, time.Now())
+	}
+
+	w := s.workload
+	class := w.classes[len(w.classes)-1]
+	pick := s.rand.Intn(w.total)
+	for _, c := range w.classes {
+		if pick < c.Weight {
+			class = c
+			break
+		}
+		pick -= c.Weight
+	}
+
+	// Use a compact header so that small payloads can be sent
+	header := fmt.Sprintf("msg %d at %d", seq, time.Now().UnixNano())
+	if pad := class.Size.sample(s.rand) - len(header) - 1; pad > 0 {
+		return class, header + " " + w.padding[:pad]
+	}
+	return class, header
+}
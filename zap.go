@@ -0,0 +1,292 @@
+package rtreq
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	zmq "github.com/pebbe/zmq4"
+)
+
+//===========================================================================
+// ZAP Authentication Handler
+//===========================================================================
+
+// ZAPAddr is the in process address that ZMQ sends authentication requests
+// to; only one handler may be bound per context.
+const ZAPAddr = "inproc://zeromq.zap.01"
+
+// ZAPVersion is the version of the ZAP protocol implemented by the handler.
+const ZAPVersion = "1.0"
+
+// ZAP status codes returned to the ZMQ security mechanism.
+const (
+	ZAPSuccess     = "200"
+	ZAPTempFailure = "300"
+	ZAPAuthFailure = "400"
+	ZAPInternal    = "500"
+)
+
+// Authenticator is a ZAP handler that authorizes connections to servers in
+// the same context as it. Connections are first checked against the IP deny
+// list and, if any networks are allowed, the IP allow list. CURVE clients are
+// then authorized if their public key is in the allowed keys, or if no
+// allowed keys have been specified; PLAIN clients are authorized if their
+// username and password match the loaded credentials.
+type Authenticator struct {
+	sync.RWMutex
+	sock    *zmq.Socket       // REP socket bound to the ZAP address
+	metrics *Metrics          // server metrics to count rejections on
+	allow   []*net.IPNet      // networks allowed to connect, any if empty
+	deny    []*net.IPNet      // networks that are not allowed to connect
+	curve   map[string]string // allowed CURVE public keys mapped to client names
+	plain   map[string]string // allowed PLAIN usernames mapped to passwords
+}
+
+// NewAuthenticator binds a ZAP handler to the context. The handler must be
+// run in its own go routine and stops when the context is terminated.
+func NewAuthenticator(context *zmq.Context) (a *Authenticator, err error) {
+	a = new(Authenticator)
+	if a.sock, err = context.NewSocket(zmq.REP); err != nil {
+		return nil, WrapError("could not create ZAP socket", err)
+	}
+
+	if err = a.sock.Bind(ZAPAddr); err != nil {
+		a.sock.Close()
+		return nil, WrapError("could not bind '%s'", err, ZAPAddr)
+	}
+
+	return a, nil
+}
+
+// AllowCurve adds the public keys (mapped to the name of the client) to the
+// set of CURVE clients that are allowed to connect.
+func (a *Authenticator) AllowCurve(keys map[string]string) {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.curve == nil {
+		a.curve = make(map[string]string, len(keys))
+	}
+
+	for key, name := range keys {
+		a.curve[key] = name
+	}
+}
+
+// Allow connections only from the specified IP addresses or CIDR networks.
+func (a *Authenticator) Allow(addrs ...string) error {
+	networks, err := parseNetworks(addrs)
+	if err != nil {
+		return err
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	a.allow = append(a.allow, networks...)
+	return nil
+}
+
+// Deny connections from the specified IP addresses or CIDR networks.
+func (a *Authenticator) Deny(addrs ...string) error {
+	networks, err := parseNetworks(addrs)
+	if err != nil {
+		return err
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	a.deny = append(a.deny, networks...)
+	return nil
+}
+
+// AllowPlain adds the usernames (mapped to passwords) to the set of PLAIN
+// clients that are allowed to connect.
+func (a *Authenticator) AllowPlain(passwords map[string]string) {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.plain == nil {
+		a.plain = make(map[string]string, len(passwords))
+	}
+
+	for username, password := range passwords {
+		a.plain[username] = password
+	}
+}
+
+// Run the handler, responding to authentication requests until the context
+// is terminated, at which point the socket is closed.
+func (a *Authenticator) Run() error {
+	defer a.sock.Close()
+	a.sock.SetLinger(0)
+
+	for {
+		request, err := a.sock.RecvMessage(0)
+		if err != nil {
+			if zmq.AsErrno(err) == zmq.ETERM {
+				return nil
+			}
+			return WrapError("could not receive ZAP request", err)
+		}
+
+		// A request has at least version, request id, domain, address,
+		// identity and mechanism frames followed by the credentials. The
+		// REP socket must reply to every request, so malformed requests
+		// are rejected rather than ignored.
+		var requestID, user string
+		code, text := ZAPAuthFailure, "malformed ZAP request"
+		if len(request) > 1 {
+			requestID = request[1]
+		}
+
+		if len(request) < 6 {
+			warn("malformed ZAP request with %d frames", len(request))
+		} else if code, text, user = a.authenticate(request[3], request[5], request[6:]); code != ZAPSuccess {
+			info("rejected %s connection from %s: %s", request[5], request[3], text)
+		}
+
+		if code != ZAPSuccess && a.metrics != nil {
+			a.metrics.Reject()
+		}
+
+		if _, err := a.sock.SendMessage(ZAPVersion, requestID, code, text, user, ""); err != nil {
+			warn("could not reply to ZAP request: %s", err)
+		}
+	}
+}
+
+// Authenticate a connection request returning the ZAP status code, status
+// text and the user id of the client if it is authorized.
+func (a *Authenticator) authenticate(address, mechanism string, credentials []string) (code, text, user string) {
+	a.RLock()
+	defer a.RUnlock()
+
+	if !a.permitted(address) {
+		return ZAPAuthFailure, "address not allowed", ""
+	}
+
+	switch mechanism {
+	case "NULL":
+		return ZAPSuccess, "OK", ""
+	case "CURVE":
+		if len(credentials) != 1 {
+			return ZAPAuthFailure, "missing client public key", ""
+		}
+
+		key := zmq.Z85encode(credentials[0])
+		if a.curve == nil {
+			return ZAPSuccess, "OK", key
+		}
+
+		if name, ok := a.curve[key]; ok {
+			return ZAPSuccess, "OK", name
+		}
+		return ZAPAuthFailure, "client key not allowed", ""
+	case "PLAIN":
+		if len(credentials) != 2 {
+			return ZAPAuthFailure, "missing username or password", ""
+		}
+
+		// Compare in constant time so the password cannot be guessed by timing
+		if password, ok := a.plain[credentials[0]]; ok && subtle.ConstantTimeCompare([]byte(password), []byte(credentials[1])) == 1 {
+			return ZAPSuccess, "OK", credentials[0]
+		}
+		return ZAPAuthFailure, "invalid username or password", ""
+	default:
+		return ZAPAuthFailure, "unsupported security mechanism", ""
+	}
+}
+
+// Determine if the address is permitted by the allow and deny lists. Must be
+// called with the read lock held.
+func (a *Authenticator) permitted(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return len(a.allow) == 0 && len(a.deny) == 0
+	}
+
+	for _, network := range a.deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(a.allow) == 0 {
+		return true
+	}
+
+	for _, network := range a.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//===========================================================================
+// Helper Functions
+//===========================================================================
+
+// LoadPasswords reads a file of PLAIN credentials with one username:password
+// pair per line. Blank lines and lines beginning with # are ignored.
+func LoadPasswords(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, WrapError("could not open passwords file", err)
+	}
+	defer f.Close()
+
+	passwords := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("could not parse credentials on line %d of %s", lineno, path)
+		}
+		passwords[parts[0]] = parts[1]
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, WrapError("could not read passwords file", err)
+	}
+
+	return passwords, nil
+}
+
+// Parse IP addresses or CIDR networks into a list of networks; a single IP
+// address is treated as a network that contains only that address.
+func parseNetworks(addrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(addrs))
+	for _, addr := range addrs {
+		if strings.Contains(addr, "/") {
+			_, network, err := net.ParseCIDR(addr)
+			if err != nil {
+				return nil, WrapError("could not parse network", err)
+			}
+			networks = append(networks, network)
+			continue
+		}
+
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("could not parse IP address '%s'", addr)
+		}
+
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return networks, nil
+}